@@ -12,6 +12,16 @@ type C struct {
 	RandomSecret     string `envconfig:"RANDOM_SECRET" required:"true"`
 	OwnerPubkey      string `envconfig:"OWNER_PUBKEY"`
 
+	KeyEncryptionPrivkey string `envconfig:"KEY_ENCRYPTION_PRIVKEY" default:""`
+
+	AdminPubkeys    []string `envconfig:"ADMIN_PUBKEYS"`
+	AuthMaxAgeSecs  int      `envconfig:"AUTH_MAX_AGE_SECS" default:"60"`
+	SessionHours    int      `envconfig:"SESSION_HOURS" default:"168"`
+	DMCommands      bool     `envconfig:"DM_COMMANDS" default:"true"`
+	NIP05Domain     string   `envconfig:"NIP05_DOMAIN"`
+	RelayListRelays []string `envconfig:"RELAY_LIST_RELAYS"`
+	ReplicateEvents bool     `envconfig:"REPLICATE_EVENTS" default:"true"`
+
 	LogLevel       string `envconfig:"LOG_LEVEL" default:"WARN"`
 	Port           string `envconfig:"PORT" default:"3334"`
 	DatabasePath   string `envconfig:"DATABASE_PATH" default:"./db/rssnotes"`
@@ -26,11 +36,20 @@ type C struct {
 	DefaultProfilePicUrl    string `envconfig:"DEFAULT_PROFILE_PICTURE_URL" default:"./assets/static/mstile-150x150.png"`
 	DeleteFailingFeeds      bool   `envconfig:"DELETE_FAILIING_FEEDS" required:"false"`
 	MaxContentLength        int    `envconfig:"MAX_CONTENT_LENGTH" default:"250"`
+	NoteTemplate            string `envconfig:"NOTE_TEMPLATE" default:"default"`
+	MaxHashtags             int    `envconfig:"MAX_HASHTAGS" default:"5"`
 	FeedItemsRefreshMinutes int    `envconfig:"FEED_ITEMS_REFRESH_MINUTES" default:"30"`
+	SeedRelayCheckMinutes   int    `envconfig:"SEED_RELAY_CHECK_MINUTES" default:"5"`
+	FeedWorkers             int    `envconfig:"FEED_WORKERS" default:"4"`
+	ShutdownTimeoutSecs     int    `envconfig:"SHUTDOWN_TIMEOUT_SECS" default:"30"`
 	FeedMetadataRefreshDays int    `envconfig:"METADATA_REFRESH_DAYS" default:"7"`
 	MaxNoteAgeDays          int    `envconfig:"MAX_NOTE_AGE_DAYS" default:"0"`
-	MaxBookmarkAgeHrs       int    `envconfig:"MAX_BOOKMARK_AGE_HRS" default:"1"`
+	RetractExpiredNotes     bool   `envconfig:"RETRACT_EXPIRED_NOTES" default:"true"`
+	RetireFeedProfile       bool   `envconfig:"RETIRE_FEED_PROFILE" default:"true"`
 	MaxAvgPostPeriodHrs     int64  `envconfig:"MAX_AVG_POST_PERIOD_HRS" default:"4"`
 	MinAvgPostPeriodMins    int64  `envconfig:"MIN_AVG_POST_PERIOD_MINS" default:"10"`
 	MinPostPeriodSamples    int    `envconfig:"MIN_POST_PERIOD_SAMPLES" default:"5"`
+	MaxSeenItemsPerFeed     int    `envconfig:"MAX_SEEN_ITEMS_PER_FEED" default:"500"`
+	FailingFeedStreak       int    `envconfig:"FAILING_FEED_STREAK" default:"10"`
+	MaxFeedBackoffHrs       int64  `envconfig:"MAX_FEED_BACKOFF_HRS" default:"24"`
 }
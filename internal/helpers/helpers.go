@@ -3,6 +3,7 @@ package helpers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -16,6 +17,7 @@ import (
 
 	md "github.com/JohannesKaufmann/html-to-markdown"
 	"github.com/PuerkitoBio/goquery"
+	"github.com/nbd-wtf/go-nostr"
 )
 
 var validSchemas = []string{"https", "http"}
@@ -138,23 +140,60 @@ func GetConverterRules() []md.Rule {
 	}
 }
 
-func GetRelayListFromFile(filePath string) []string {
+var validRelaySchemas = []string{"wss", "ws"}
+
+var ErrInvalidRelayURL = errors.New("invalid relay url, it needs to be ws:// or wss://")
+
+// NormalizeRelayURL checks a relay url and brings it into the form go-nostr
+// uses. Bare hosts get wss://.
+func NormalizeRelayURL(rawUrl string) (string, error) {
+	rawUrl = strings.TrimSpace(rawUrl)
+	if !strings.Contains(rawUrl, "://") {
+		rawUrl = "wss://" + rawUrl
+	}
+
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil || parsedUrl.Host == "" || !slices.Contains(validRelaySchemas, strings.ToLower(parsedUrl.Scheme)) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidRelayURL, rawUrl)
+	}
+	return nostr.NormalizeURL(rawUrl), nil
+}
+
+// GetRelayListFromFile reads a json list of relay urls, like
+// sample.seedrelays.json.
+func GetRelayListFromFile(filePath string) ([]string, error) {
 	file, err := os.ReadFile(filePath)
 	if err != nil {
-		log.Fatalf("Failed to read file: %s", err)
+		return nil, err
 	}
 
 	var relayList []string
 	if err := json.Unmarshal(file, &relayList); err != nil {
-		log.Fatalf("Failed to parse JSON: %s", err)
+		return nil, fmt.Errorf("parsing %s: %w", filePath, err)
 	}
 
-	for i, relay := range relayList {
-		relayList[i] = "wss://" + strings.TrimSpace(relay)
+	urls := make([]string, 0, len(relayList))
+	for _, relay := range relayList {
+		relayUrl, err := NormalizeRelayURL(relay)
+		if err != nil {
+			log.Printf("[WARN] %s: %s", filePath, err)
+			continue
+		}
+		urls = append(urls, relayUrl)
+	}
+	return urls, nil
+}
+
+// NextFeedUpdate is when a feed is due again: the average post time after
+// the last check, or the backoff when the feed is failing.
+func NextFeedUpdate(rssfeed models.Entity) int64 {
+	interval := rssfeed.AvgPostTime
+	if rssfeed.ConsecutiveFailures > 0 {
+		interval = max(interval, rssfeed.BackoffSecs)
 	}
-	return relayList
+	return rssfeed.LastCheckedTime + interval
 }
 
 func TimetoUpdateFeed(rssfeed models.Entity) bool {
-	return time.Now().Unix()-rssfeed.LastCheckedTime >= rssfeed.AvgPostTime
+	return time.Now().Unix() >= NextFeedUpdate(rssfeed)
 }
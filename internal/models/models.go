@@ -25,19 +25,91 @@ type ImportProgressStruct struct {
 	TotalEntries int
 }
 
+// EntitySchemaVersion is bumped whenever stored entities need a migration.
+const EntitySchemaVersion = 4
+
 type Entity struct {
-	PubKey          string
-	PrivateKey      string
-	URL             string
-	ImageURL        string
-	LastPostTime    int64
-	AvgPostTime     int64
-	LastCheckedTime int64
+	SchemaVersion       int
+	PubKey              string
+	PrivateKey          string // plain text, only set in memory
+	EncryptedPrivateKey string // nip44, what the registry stores
+	URL                 string
+	Title               string // feed title, from the OPML import or the first check
+	SiteURL             string
+	Categories          []string // folder paths like "Tech/Go", from OPML imports
+	ImageURL            string
+	LastPostTime        int64
+	AvgPostTime         int64
+	LastCheckedTime     int64
+	ETag                string // validators of the last full download
+	LastModified        string
+	ConsecutiveFailures int
+	LastErrorClass      FeedErrorClass
+	LastError           string
+	LastSuccessTime     int64
+	BackoffSecs         int64
+	NoteTemplate        string // style name or text/template source, empty for the default
+	OutputMode          OutputMode
+	HashtagAllow        []string // only these categories become hashtags, when set
+	HashtagDeny         []string
+	AppendHashtags      bool   // also write the hashtags at the end of notes
+	Paused              bool   // not checked until resumed
+	NIP05Name           string // local part of the nip05 identifier, unique among feeds
+	LocalOnly           bool   // events are not replicated to the seed relays
+}
+
+// OutputMode is how a feed publishes its items.
+type OutputMode string
+
+const (
+	OutputNotes          OutputMode = ""                // kind-1 notes
+	OutputLongForm       OutputMode = "longform"        // NIP-23 articles
+	OutputLongFormTeaser OutputMode = "longform-teaser" // articles plus a kind-1 teaser
+)
+
+// OutputModes lists the valid output modes.
+var OutputModes = []OutputMode{OutputNotes, OutputLongForm, OutputLongFormTeaser}
+
+// FeedErrorClass tells what kind of failure the last feed check ran into.
+type FeedErrorClass string
+
+const (
+	FeedErrorNone    FeedErrorClass = ""
+	FeedErrorURL     FeedErrorClass = "url"
+	FeedErrorDNS     FeedErrorClass = "dns"
+	FeedErrorNetwork FeedErrorClass = "network"
+	FeedErrorHTTP    FeedErrorClass = "http"
+	FeedErrorParse   FeedErrorClass = "parse"
+	FeedErrorStore   FeedErrorClass = "store" // the feed key or seen items could not be read
+)
+
+// SeedRelayDeadAfter failed probes in a row mark a seed relay dead. Dead
+// relays are skipped until a probe succeeds again.
+const SeedRelayDeadAfter = 2
+
+// SeedRelay is a relay that events are replicated to (Write) and that follow
+// lists and direct messages are read from (Read), with its last probes.
+type SeedRelay struct {
+	URL                 string
+	Read                bool
+	Write               bool
+	AddedTime           int64
+	LastCheckedTime     int64
+	LastSuccessTime     int64
+	LatencyMs           int64
+	ConsecutiveFailures int
+	LastError           string
+}
+
+// Dead tells whether the last probes of the relay failed.
+func (r SeedRelay) Dead() bool {
+	return r.ConsecutiveFailures >= SeedRelayDeadAfter
 }
 
 type GUIEntry struct {
 	BookmarkEntity Entity
 	NPubKey        string
+	NProfile       string // npub with this relay as hint
 	Error          bool
 	ErrorMessage   string
 	ErrorCode      int
@@ -66,6 +138,8 @@ type OpmlOutline struct {
 	Title        string        `xml:"title,attr,omitempty"`
 	Version      string        `xml:"version,attr,omitempty"`
 	Description  string        `xml:"description,attr,omitempty"`
+	NPub         string        `xml:"npub,attr,omitempty"`  // rssnotes export only
+	NIP05        string        `xml:"nip05,attr,omitempty"` // rssnotes export only
 }
 
 // OpmlBody is the parent structure of all outlines.
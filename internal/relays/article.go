@@ -0,0 +1,136 @@
+package relays
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"rssnotes/internal/models"
+	"rssnotes/internal/yarr/yarrparser"
+	"rssnotes/metrics"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+const (
+	KIND_LONG_FORM int = 30023 //NIP-23
+
+	maxArticleSummaryLength = 300
+)
+
+// articleIdentifier is the d tag of the article of an item, stable across
+// versions of the item.
+func articleIdentifier(item *yarrparser.Item) string {
+	if item.GUID != "" {
+		return item.GUID
+	}
+	return itemSeenKey(item)
+}
+
+// feedItemToArticle builds a NIP-23 long-form article with the full content
+// of an item as markdown.
+func feedItemToArticle(entity models.Entity, item *yarrparser.Item, feed *yarrparser.Feed, createdAt time.Time) nostr.Event {
+	data := newNoteData(entity, item, feed, maxArticleSummaryLength)
+
+	content := data.Markdown
+	if data.Link != "" {
+		content += "\n\n" + data.Link
+	}
+
+	publishedAt := createdAt
+	if !item.Date.IsZero() && item.Date.Before(publishedAt) {
+		publishedAt = item.Date
+	}
+
+	tags := nostr.Tags{
+		{"d", articleIdentifier(item)},
+		{"title", data.Title},
+		{"published_at", fmt.Sprintf("%d", publishedAt.Unix())},
+		{"proxy", itemProxyLink(item, feed), "rss"},
+	}
+	if summary := truncateText(maxArticleSummaryLength, data.Text); summary != "" {
+		tags = append(tags, nostr.Tag{"summary", summary})
+	}
+	if image := articleImage(item); image != "" {
+		tags = append(tags, nostr.Tag{"image", image})
+	}
+	if data.Link != "" {
+		tags = append(tags, nostr.Tag{"r", data.Link})
+	}
+	tags = append(tags, hashtagTags(data.Tags)...)
+
+	evt := nostr.Event{
+		PubKey:    entity.PubKey,
+		CreatedAt: nostr.Timestamp(createdAt.Unix()),
+		Kind:      KIND_LONG_FORM,
+		Tags:      tags,
+		Content:   strings.ToValidUTF8(content, ""),
+	}
+	attachMedia(&evt, itemMedia(item, item.Summary+item.Content))
+	evt.ID = string(evt.Serialize())
+
+	return evt
+}
+
+func articleImage(item *yarrparser.Item) string {
+	if item.ImageURL != "" {
+		return item.ImageURL
+	}
+	for _, enclosure := range item.Enclosures {
+		if strings.HasPrefix(enclosure.Type, "image/") {
+			return enclosure.URL
+		}
+	}
+	return ""
+}
+
+// feedItemToTeaser builds a short note in the feed note style that points
+// to the article of the item.
+func feedItemToTeaser(entity models.Entity, item *yarrparser.Item, feed *yarrparser.Feed, article *nostr.Event, createdAt time.Time, maxContentLength int) nostr.Event {
+	evt := feedItemToNote(entity, item, feed, createdAt, maxContentLength)
+
+	d := article.Tags.GetD()
+	naddr, err := nip19.EncodeEntity(entity.PubKey, KIND_LONG_FORM, d, []string{PublicRelayURL()})
+	if err != nil {
+		log.Printf("[ERROR] encoding naddr: %s", err)
+		return evt
+	}
+
+	evt.Content += "\n\nnostr:" + naddr
+	evt.Tags = append(evt.Tags, nostr.Tag{"a", fmt.Sprintf("%d:%s:%s", KIND_LONG_FORM, entity.PubKey, d), PublicRelayURL()})
+	evt.ID = string(evt.Serialize())
+
+	return evt
+}
+
+// publishArticle publishes an article and drops the versions it replaces.
+func publishArticle(article *nostr.Event, privateKey string) error {
+	if err := publishEvent(article, privateKey); err != nil {
+		return err
+	}
+
+	previous, err := getLocalEvents(nostr.Filter{
+		Authors: []string{article.PubKey},
+		Kinds:   []int{KIND_LONG_FORM},
+		Tags:    nostr.TagMap{"d": []string{article.Tags.GetD()}},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, evt := range previous {
+		if evt.ID == article.ID || evt.CreatedAt > article.CreatedAt {
+			continue
+		}
+		for _, del := range rly.DeleteEvent {
+			if err := del(context.TODO(), evt); err != nil {
+				log.Printf("[ERROR] deleting replaced article %s: %s", evt.ID, err)
+			}
+		}
+	}
+
+	metrics.KindLongFormCreated.Inc()
+	return nil
+}
@@ -0,0 +1,43 @@
+package relays
+
+import (
+	"rssnotes/internal/models"
+	"slices"
+	"strings"
+)
+
+// NormalizeCategory trims every level of a folder path like " Tech / Go "
+// and joins them with "/". Empty levels are dropped.
+func NormalizeCategory(category string) string {
+	levels := make([]string, 0)
+	for _, level := range strings.Split(category, "/") {
+		if level = strings.TrimSpace(level); level != "" {
+			levels = append(levels, level)
+		}
+	}
+	return strings.Join(levels, "/")
+}
+
+// MergeCategories appends the categories of add that categories lacks.
+func MergeCategories(categories []string, add ...string) []string {
+	for _, category := range add {
+		if category = NormalizeCategory(category); category != "" && !slices.Contains(categories, category) {
+			categories = append(categories, category)
+		}
+	}
+	return categories
+}
+
+// SetFeedCategories replaces the categories of a feed.
+func SetFeedCategories(pubkeyHex string, categories []string) error {
+	return UpdateEntity(pubkeyHex, func(e *models.Entity) {
+		e.Categories = MergeCategories(nil, categories...)
+	})
+}
+
+// AddFeedCategories puts a feed into more categories.
+func AddFeedCategories(pubkeyHex string, categories []string) error {
+	return UpdateEntity(pubkeyHex, func(e *models.Entity) {
+		e.Categories = MergeCategories(e.Categories, categories...)
+	})
+}
@@ -0,0 +1,172 @@
+package relays
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"rssnotes/metrics"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// deletionBatchSize caps the events referenced by one kind-5 request, so
+// that relays accept it.
+const deletionBatchSize = 500
+
+// feedPrivateKeys returns the private keys of all feeds by pubkey, or of
+// the replicated ones only.
+func feedPrivateKeys(replicatedOnly bool) map[string]string {
+	privateKeys := make(map[string]string)
+
+	entities, err := GetSavedEntities()
+	if err != nil {
+		log.Printf("[ERROR] loading feed keys: %s", err)
+		return privateKeys
+	}
+	for _, entity := range entities {
+		if replicatedOnly && !replicates(entity) {
+			continue
+		}
+		privateKey, err := openPrivateKey(entity)
+		if err != nil {
+			log.Printf("[ERROR] could not decrypt private key of %s: %s", entity.URL, err)
+			continue
+		}
+		privateKeys[entity.PubKey] = privateKey
+	}
+	return privateKeys
+}
+
+// storeLocalEvent saves an event of the relay and hands it to subscribers.
+func storeLocalEvent(evt *nostr.Event) {
+	rly.BroadcastEvent(evt)
+	for _, store := range rly.StoreEvent {
+		if err := store(context.TODO(), evt); err != nil {
+			log.Printf("[ERROR] storing event %s: %s", evt.ID, err)
+		}
+	}
+}
+
+// deletionRequests signs NIP-09 kind-5 events asking relays to delete evts,
+// which must all be by the pubkey of privateKey.
+func deletionRequests(evts []*nostr.Event, privateKey, reason string) ([]nostr.Event, error) {
+	pubkey, err := nostr.GetPublicKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	requests := make([]nostr.Event, 0, len(evts)/deletionBatchSize+1)
+	for batch := range slices.Chunk(evts, deletionBatchSize) {
+		tags := make(nostr.Tags, 0, len(batch)+2)
+		kinds := make([]int, 0, 2)
+		for _, evt := range batch {
+			tags = append(tags, nostr.Tag{"e", evt.ID})
+			if evt.Kind >= 30000 && evt.Kind < 40000 {
+				tags = append(tags, nostr.Tag{"a", fmt.Sprintf("%d:%s:%s", evt.Kind, evt.PubKey, evt.Tags.GetD())})
+			}
+			if !slices.Contains(kinds, evt.Kind) {
+				kinds = append(kinds, evt.Kind)
+			}
+		}
+		for _, kind := range kinds {
+			tags = append(tags, nostr.Tag{"k", strconv.Itoa(kind)})
+		}
+
+		request := nostr.Event{
+			PubKey:    pubkey,
+			CreatedAt: nostr.Now(),
+			Kind:      nostr.KindDeletion,
+			Tags:      tags,
+			Content:   reason,
+		}
+		if err := request.Sign(privateKey); err != nil {
+			return nil, err
+		}
+		requests = append(requests, request)
+	}
+	return requests, nil
+}
+
+// retractEvents deletes the events matching filter from the store. The
+// events of the pubkeys in privateKeys are also retracted everywhere else,
+// with deletion requests that are stored and replicated to the seed relays.
+func retractEvents(filter nostr.Filter, privateKeys map[string]string, reason string) error {
+	events, err := getLocalEvents(filter)
+	if err != nil || len(events) == 0 {
+		return err
+	}
+
+	byAuthor := make(map[string][]*nostr.Event)
+	for _, evt := range events {
+		if _, ok := privateKeys[evt.PubKey]; ok {
+			byAuthor[evt.PubKey] = append(byAuthor[evt.PubKey], evt)
+		}
+	}
+
+	requests := make([]nostr.Event, 0, len(byAuthor))
+	for pubkey, authored := range byAuthor {
+		authorRequests, err := deletionRequests(authored, privateKeys[pubkey], reason)
+		if err != nil {
+			log.Printf("[ERROR] signing deletion request of %s: %s", pubkey, err)
+			continue
+		}
+		requests = append(requests, authorRequests...)
+	}
+
+	deleteStoredEvents(events)
+
+	for i := range requests {
+		storeLocalEvent(&requests[i])
+	}
+	metrics.DeletionRequestsCreated.Add(float64(len(requests)))
+	enqueueReplication(requests...)
+
+	log.Printf("[DEBUG] %d events deleted, %d deletion requests sent", len(events), len(requests))
+	return nil
+}
+
+// retireFeedProfile replaces the profile of a deleted feed with one saying
+// that the relay no longer mirrors it.
+func retireFeedProfile(pubkey, privateKey string) (nostr.Event, error) {
+	profile, previous, err := getLocalMetadataEvent(pubkey)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+
+	name := strings.TrimSuffix(profile.Name, " (RSS Feed)")
+	if name == "" {
+		name = "RSS Feed"
+	}
+	metadata := map[string]string{
+		"name":    name + " (retired)",
+		"about":   strings.TrimSpace(fmt.Sprintf("This feed was retired and is no longer mirrored by %s.\n\n%s", s.RelayURL, profile.About)),
+		"picture": profile.Picture,
+	}
+
+	content, err := json.Marshal(metadata)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+
+	evt := nostr.Event{
+		PubKey:    pubkey,
+		CreatedAt: max(nostr.Now(), previous.CreatedAt+1),
+		Kind:      nostr.KindProfileMetadata,
+		Content:   string(content),
+	}
+	if err := evt.Sign(privateKey); err != nil {
+		return nostr.Event{}, err
+	}
+
+	if err := deleteLocalEvents(nostr.Filter{
+		Authors: []string{pubkey},
+		Kinds:   []int{nostr.KindProfileMetadata}}); err != nil {
+		return nostr.Event{}, err
+	}
+	storeLocalEvent(&evt)
+	return evt, nil
+}
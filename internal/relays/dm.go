@@ -0,0 +1,253 @@
+package relays
+
+import (
+	"context"
+	"errors"
+	"log"
+	"rssnotes/internal/models"
+	"slices"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/keyer"
+	"github.com/nbd-wtf/go-nostr/nip04"
+	"github.com/nbd-wtf/go-nostr/nip17"
+	"github.com/nbd-wtf/go-nostr/nip59"
+)
+
+// registryHandledDMPrefix keys mark direct messages that were already
+// answered, so that a restart does not run a command twice.
+const registryHandledDMPrefix byte = 132
+
+const (
+	KIND_GIFT_WRAP    int = 1059  //NIP-59
+	KIND_CHAT_MESSAGE int = 14    //NIP-17
+	KIND_DM_RELAYS    int = 10050 //NIP-17
+
+	// gift wraps are backdated by up to two days, so the subscription looks
+	// that far back and the handled set remembers a bit longer
+	giftWrapBackdate = 48 * time.Hour
+	handledDMTTL     = 72 * time.Hour
+
+	// older messages are ignored, in case they were meant for a previous
+	// state of the relay
+	maxDMAge = time.Hour
+)
+
+// DirectMessage is a decrypted NIP-04 or NIP-17 message to the relay pubkey.
+type DirectMessage struct {
+	ID        string
+	Sender    string
+	Content   string
+	CreatedAt nostr.Timestamp
+	GiftWrap  bool // arrived as NIP-17 and is answered the same way
+}
+
+func registryHandledDMKey(id string) []byte {
+	return append([]byte{registryHandledDMPrefix}, []byte(id)...)
+}
+
+// markDMHandled records a message and reports whether it was new.
+func markDMHandled(id string) (bool, error) {
+	isNew := false
+	err := db.Update(func(txn *badger.Txn) error {
+		if _, err := txn.Get(registryHandledDMKey(id)); err == nil {
+			return nil
+		} else if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+		isNew = true
+		return txn.SetEntry(badger.NewEntry(registryHandledDMKey(id), nil).WithTTL(handledDMTTL))
+	})
+	return isNew, err
+}
+
+// ListenForDirectMessages subscribes on the read seed relays to NIP-04 and
+// NIP-17 messages sent to the relay pubkey by one of senders, and hands each
+// new one to handle in turn until ctx is done. It subscribes again whenever
+// the seed relays change.
+func ListenForDirectMessages(ctx context.Context, senders []string, handle func(DirectMessage)) {
+	kr, err := keyer.NewPlainKeySigner(s.RelayPrivkey)
+	if err != nil {
+		log.Printf("[ERROR] direct messages: %s", err)
+		return
+	}
+
+	since := nostr.Timestamp(time.Now().Add(-giftWrapBackdate).Unix())
+	filters := nostr.Filters{
+		{Kinds: []int{nostr.KindEncryptedDirectMessage}, Authors: senders, Tags: nostr.TagMap{"p": []string{s.RelayPubkey}}, Since: &since},
+		{Kinds: []int{KIND_GIFT_WRAP}, Tags: nostr.TagMap{"p": []string{s.RelayPubkey}}, Since: &since},
+	}
+
+	var listed []string
+	for {
+		if urls := seedRelayURLs(func(r models.SeedRelay) bool { return r.Read }); !slices.Equal(urls, listed) {
+			publishDMRelayList(urls)
+			listed = urls
+		}
+
+		urls := readRelays()
+		subCtx, cancel := context.WithCancel(ctx)
+		log.Printf("[INFO] listening for direct messages from %d pubkeys on %d relays", len(senders), len(urls))
+		receiveDirectMessages(subCtx, kr, pool.SubMany(subCtx, urls, filters), senders, handle)
+		cancel()
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// receiveDirectMessages handles the events of one subscription until ctx is
+// done or the seed relays change.
+func receiveDirectMessages(ctx context.Context, kr keyer.KeySigner, events chan nostr.RelayEvent, senders []string, handle func(DirectMessage)) {
+	for {
+		var ie nostr.RelayEvent
+		var ok bool
+		select {
+		case <-ctx.Done():
+			return
+		case <-seedRelaysChanged:
+			return
+		case ie, ok = <-events:
+		}
+		if !ok {
+			// no relay left to listen on, wait for the list to change
+			events = nil
+			continue
+		}
+
+		msg, err := openDirectMessage(ctx, kr, *ie.Event)
+		if err != nil {
+			log.Printf("[DEBUG] skipping direct message %s: %s", ie.Event.ID, err)
+			continue
+		}
+
+		if !slices.Contains(senders, msg.Sender) {
+			log.Printf("[INFO] ignoring direct message from %s", msg.Sender)
+			continue
+		}
+		if time.Since(msg.CreatedAt.Time()) > maxDMAge {
+			continue
+		}
+		if isNew, err := markDMHandled(msg.ID); err != nil {
+			log.Printf("[ERROR] direct message %s: %s", msg.ID, err)
+			continue
+		} else if !isNew {
+			continue
+		}
+
+		handle(msg)
+	}
+}
+
+func openDirectMessage(ctx context.Context, kr keyer.KeySigner, evt nostr.Event) (DirectMessage, error) {
+	if ok, _ := evt.CheckSignature(); !ok {
+		return DirectMessage{}, errors.New("invalid signature")
+	}
+
+	if evt.Kind == nostr.KindEncryptedDirectMessage {
+		sharedSecret, err := nip04.ComputeSharedSecret(evt.PubKey, s.RelayPrivkey)
+		if err != nil {
+			return DirectMessage{}, err
+		}
+		content, err := nip04.Decrypt(evt.Content, sharedSecret)
+		if err != nil {
+			return DirectMessage{}, err
+		}
+		return DirectMessage{ID: evt.ID, Sender: evt.PubKey, Content: content, CreatedAt: evt.CreatedAt}, nil
+	}
+
+	rumor, err := nip59.GiftUnwrap(evt, func(otherpubkey, ciphertext string) (string, error) {
+		return kr.Decrypt(ctx, ciphertext, otherpubkey)
+	})
+	if err != nil {
+		return DirectMessage{}, err
+	}
+	if rumor.Kind != KIND_CHAT_MESSAGE {
+		return DirectMessage{}, errors.New("not a chat message")
+	}
+	return DirectMessage{ID: rumor.ID, Sender: rumor.PubKey, Content: rumor.Content, CreatedAt: rumor.CreatedAt, GiftWrap: true}, nil
+}
+
+// ReplyDirectMessage answers msg the way it came in: NIP-17 replies go to
+// the DM relays of the sender, or the seed relays when it has none.
+func ReplyDirectMessage(msg DirectMessage, content string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	replyTags := nostr.Tags{{"e", msg.ID}}
+
+	var reply nostr.Event
+	targets := liveWriteRelays()
+	if msg.GiftWrap {
+		kr, err := keyer.NewPlainKeySigner(s.RelayPrivkey)
+		if err != nil {
+			return err
+		}
+		if _, reply, err = nip17.PrepareMessage(ctx, content, replyTags, kr, msg.Sender, nil); err != nil {
+			return err
+		}
+		if dmRelays := nip17.GetDMRelays(ctx, msg.Sender, pool, readRelays()); len(dmRelays) > 0 {
+			targets = dmRelays
+		}
+	} else {
+		sharedSecret, err := nip04.ComputeSharedSecret(msg.Sender, s.RelayPrivkey)
+		if err != nil {
+			return err
+		}
+		encrypted, err := nip04.Encrypt(content, sharedSecret)
+		if err != nil {
+			return err
+		}
+		reply = nostr.Event{
+			PubKey:    s.RelayPubkey,
+			CreatedAt: nostr.Now(),
+			Kind:      nostr.KindEncryptedDirectMessage,
+			Tags:      append(nostr.Tags{{"p", msg.Sender}}, replyTags...),
+			Content:   encrypted,
+		}
+		if err := reply.Sign(s.RelayPrivkey); err != nil {
+			return err
+		}
+	}
+
+	sent := 0
+	for _, url := range targets {
+		relay, err := pool.EnsureRelay(url)
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			continue
+		}
+		if err := relay.Publish(ctx, reply); err != nil {
+			log.Printf("[DEBUG] direct message reply to %s: %s", url, err)
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		return errors.New("reply not accepted by any relay")
+	}
+	return nil
+}
+
+// publishDMRelayList tells NIP-17 clients to send messages for the relay
+// pubkey to urls. It goes out even when REPLICATE_EVENTS is off, direct
+// messages do not work without it.
+func publishDMRelayList(urls []string) {
+	evt := nostr.Event{
+		PubKey:    s.RelayPubkey,
+		CreatedAt: nostr.Now(),
+		Kind:      KIND_DM_RELAYS,
+		Tags:      make(nostr.Tags, 0, len(urls)),
+	}
+	for _, url := range urls {
+		evt.Tags = append(evt.Tags, nostr.Tag{"relay", url})
+	}
+	if err := evt.Sign(s.RelayPrivkey); err != nil {
+		log.Printf("[ERROR] signing dm relay list: %s", err)
+		return
+	}
+	enqueueReplication(evt)
+}
@@ -3,17 +3,14 @@ package relays
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"log"
-	"os"
 	"rssnotes/internal/models"
 	"rssnotes/metrics"
 	"sort"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/nbd-wtf/go-nostr"
-	"github.com/nbd-wtf/go-nostr/nip19"
 )
 
 const KIND_BOOKMARKS int = 10003 //NIP-51
@@ -88,7 +85,7 @@ func getRemoteFollows(pubkeyHex string) nostr.Tags {
 	}}
 
 	relayEvents := make([]nostr.RelayEvent, 0)
-	for ev := range pool.SubManyEose(timeoutCtx, seedRelays, filters) {
+	for ev := range pool.SubManyEose(timeoutCtx, readRelays(), filters) {
 		relayEvents = append(relayEvents, ev)
 	}
 
@@ -129,7 +126,7 @@ func getLocalFollows() nostr.Tags {
 	}
 
 	for _, savedEnt := range savedEnts {
-		localFollows = append(localFollows, nostr.Tag{"p", savedEnt.PubKey})
+		localFollows = append(localFollows, nostr.Tag{"p", savedEnt.PubKey, PublicRelayURL()})
 	}
 
 	return localFollows
@@ -143,7 +140,7 @@ func getUniqueFollows(followListA nostr.Tags, followListB nostr.Tags) nostr.Tags
 
 	for _, followA := range followListA {
 		for _, followB := range followListB {
-			if len(followA) != 2 || len(followB) != 2 ||
+			if len(followA) < 2 || len(followB) < 2 ||
 				followA.Key() != "p" || followB.Key() != "p" ||
 				len(followA.Value()) != 64 || len(followB.Value()) != 64 ||
 				followA.Value() == followB.Value() {
@@ -152,7 +149,7 @@ func getUniqueFollows(followListA nostr.Tags, followListB nostr.Tags) nostr.Tags
 			}
 		}
 		if !badPubkey {
-			uniqueFollows = append(uniqueFollows, nostr.Tag{"p", followA.Value()})
+			uniqueFollows = append(uniqueFollows, followA)
 		}
 		badPubkey = false
 	}
@@ -192,358 +189,19 @@ func deleteRemoteFollow(pubkeyHex string) nostr.Tags {
 	return nil
 }
 
-// TRUE if feed exists in bookmark event
-func FeedExists(pubkeyHex, privKeyHex, feedUrl string) (bool, error) {
-
-	if feedUrl == "" {
-		log.Printf("[ERROR] feedURL is empty")
-		return false, fmt.Errorf("feedURL is empty")
-	}
-
-	var bookMarkTags nostr.Tags
-
-	var bookmarkFilter nostr.Filter = nostr.Filter{
-		Kinds:   []int{KIND_BOOKMARKS},
-		Authors: []string{s.RelayPubkey},
-	}
-
-	bookMarkEvts, err := getLocalEvents(bookmarkFilter)
-	if err != nil {
-		log.Printf("[ERROR] GetLocalEvent %s", err)
-		return false, err
-	}
-
-	if len(bookMarkEvts) > 0 {
-		bookMarkTags = bookMarkEvts[0].Tags.GetAll([]string{s.RsslayTagKey})
-		for _, tag := range bookMarkTags {
-			if strings.Contains(tag.Value(), pubkeyHex) || strings.Contains(tag.Value(), privKeyHex) || strings.Contains(tag.Value(), feedUrl) {
-				log.Printf("[DEBUG] feedUrl %s already exists", feedUrl)
-				return true, nil
-			}
-		}
-	}
-
-	log.Printf("[DEBUG] feed %s does not exist", feedUrl)
-	return false, nil
-}
-
-func AddEntityToBookmarkEvent(entitiesToAdd []models.Entity) error {
-	if len(entitiesToAdd) == 0 {
-		return nil
-	}
-
-	var bookMarkTags nostr.Tags
-
-	var bookmarkFilter nostr.Filter = nostr.Filter{
-		Kinds:   []int{KIND_BOOKMARKS},
-		Authors: []string{s.RelayPubkey},
-	}
-
-	bookMarkEvts, err := getLocalEvents(bookmarkFilter)
-	if err != nil {
-		log.Printf("[ERROR] GetLocalEvent %s", err)
-		return err
-	}
-
-	if len(bookMarkEvts) > 0 {
-		bookMarkTags = bookMarkEvts[0].Tags.GetAll([]string{s.RsslayTagKey})
-	}
-
-	for _, ent := range entitiesToAdd {
-		entityByteArr, err := json.Marshal(ent)
-		if err == nil {
-			bookMarkTags = append(bookMarkTags, nostr.Tag{s.RsslayTagKey, string(entityByteArr)})
-		} else {
-			log.Printf("[ERROR] %s", err)
-		}
-	}
-
-	evt := nostr.Event{
-		CreatedAt: nostr.Now(),
-		Kind:      KIND_BOOKMARKS,
-		Content:   "{rsslay, pubkey, privkey, url, last_update}",
-		Tags:      bookMarkTags,
-	}
-
-	if err := evt.Sign(s.RelayPrivkey); err != nil {
-		log.Printf("[ERROR] signing event %s", err)
-		return err
-	}
-
-	// to store these events you must call the store functions manually
-	for _, store := range rly.StoreEvent {
-		store(context.TODO(), &evt)
-	}
-	metrics.KindBookmarkNotesCreated.Inc()
-
-	log.Printf("[DEBUG] bookmark event %s stored", evt.ID)
-	return nil
-}
-
-// update entity time properties
-func updateEntityTimesInBookmarkEvent(updatedEntity models.Entity) error {
-	var bookMarkTags nostr.Tags
-	var rssnotesEntity models.Entity
-
-	var bookmarkFilter nostr.Filter = nostr.Filter{
-		Kinds:   []int{KIND_BOOKMARKS},
-		Authors: []string{s.RelayPubkey},
-	}
-
-	bookMarkEvts, err := getLocalEvents(bookmarkFilter)
-	if err != nil {
-		log.Printf("[ERROR] GetLocalEvent %s", err)
-		return err
-	}
-
-	if len(bookMarkEvts) > 0 {
-		bookMarkTags = bookMarkEvts[0].Tags.GetAll([]string{s.RsslayTagKey})
-		for i, tag := range bookMarkTags {
-			if strings.Contains(tag.Value(), updatedEntity.PubKey) {
-				if err := json.Unmarshal([]byte(tag.Value()), &rssnotesEntity); err != nil {
-					log.Printf("[ERROR] %s", err)
-				}
-
-				copy(bookMarkTags[i:], bookMarkTags[i+1:])
-				bookMarkTags[len(bookMarkTags)-1] = nostr.Tag{}
-				bookMarkTags = bookMarkTags[:len(bookMarkTags)-1]
-
-				rssnotesEntity.LastPostTime = updatedEntity.LastPostTime
-				rssnotesEntity.LastCheckedTime = updatedEntity.LastCheckedTime
-				rssnotesEntity.AvgPostTime = updatedEntity.AvgPostTime
-
-				jsonentArr, err := json.Marshal(rssnotesEntity)
-				if err != nil {
-					log.Printf("[ERROR] %s", err)
-				}
-
-				bookMarkTags = append(bookMarkTags, nostr.Tag{s.RsslayTagKey, string(jsonentArr)})
-
-				evt := nostr.Event{
-					CreatedAt: nostr.Now(),
-					Kind:      KIND_BOOKMARKS,
-					Content:   "",
-					Tags:      bookMarkTags,
-				}
-
-				if err := evt.Sign(s.RelayPrivkey); err != nil {
-					log.Printf("[ERROR] signing event %s", err)
-					return err
-				}
-
-				for _, store := range rly.StoreEvent {
-					store(context.TODO(), &evt)
-				}
-				metrics.KindBookmarkNotesCreated.Inc()
-
-				log.Printf("[DEBUG] entity %s last post time %d in event ID %s", rssnotesEntity.URL, rssnotesEntity.LastPostTime, evt.ID)
-				break
-			}
-		}
-	} else {
-		log.Printf("[DEBUG] bookmark event not found")
-	}
-
-	return nil
-}
-
-func DeleteEntityInBookmarkEvent(pubKeyORfeedUrl string) error {
-	var bookMarkTags nostr.Tags
-	var rsslayEntity models.Entity
-
-	var bookmarkFilter nostr.Filter = nostr.Filter{
-		Kinds:   []int{KIND_BOOKMARKS},
-		Authors: []string{s.RelayPubkey},
-	}
-
-	bookMarkEvts, err := getLocalEvents(bookmarkFilter)
-	if err != nil {
-		log.Printf("[ERROR] GetLocalEvent %s", err)
+func deleteLocalEvents(filter nostr.Filter) error {
+	events, err := getLocalEvents(filter)
+	if err != nil || len(events) < 1 {
 		return err
 	}
 
-	if len(bookMarkEvts) > 0 {
-		bookMarkTags = bookMarkEvts[0].Tags.GetAll([]string{s.RsslayTagKey})
-		for i, tag := range bookMarkTags {
-			if strings.Contains(tag.Value(), pubKeyORfeedUrl) {
-
-				copy(bookMarkTags[i:], bookMarkTags[i+1:])
-				bookMarkTags[len(bookMarkTags)-1] = nostr.Tag{}
-				bookMarkTags = bookMarkTags[:len(bookMarkTags)-1]
-
-				evt := nostr.Event{
-					CreatedAt: nostr.Now(),
-					Kind:      KIND_BOOKMARKS,
-					Content:   "{rsslay, pubkey, privkey, url, last_update}",
-					Tags:      bookMarkTags,
-				}
-
-				if err := evt.Sign(s.RelayPrivkey); err != nil {
-					log.Printf("[ERROR] signing event %s", err)
-					return err
-				}
-
-				for _, store := range rly.StoreEvent {
-					store(context.TODO(), &evt)
-				}
-				metrics.KindBookmarkNotesCreated.Inc()
-
-				if err := json.Unmarshal([]byte(tag.Value()), &rsslayEntity); err != nil {
-					log.Printf("[ERROR] %s", err)
-					return err
-				}
-
-				//delete related notes
-				if err := deleteLocalEvents(nostr.Filter{
-					Authors: []string{rsslayEntity.PubKey},
-					Kinds:   []int{nostr.KindTextNote, nostr.KindProfileMetadata}}); err != nil {
-					log.Printf("[ERROR] deleting feed events: %s", err)
-				}
-
-				npub, err := nip19.EncodePublicKey(rsslayEntity.PubKey)
-				if err != nil {
-					log.Printf("[ERROR] %s", err)
-					return err
-				}
-
-				if err := os.Remove(fmt.Sprintf("%s/%s.png", s.QRCodePath, npub)); err != nil {
-					log.Print("[ERROR] qrcode delete: ", err)
-					return err
-				}
-
-				log.Printf("[DEBUG] entity %s deleted. new event ID %s saved", rsslayEntity.URL, evt.ID)
-				break
-			}
-		}
-	} else {
-		log.Printf("[DEBUG] bookmark event not found")
-	}
+	deleteStoredEvents(events)
+	log.Printf("[DEBUG] %v events deleted", len(events))
 	return nil
 }
 
-func GetSavedEntries() ([]models.GUIEntry, error) {
-
-	var bookMarkTags nostr.Tags
-	var rsslayEntity models.Entity
-
-	var bookmarkFilter nostr.Filter = nostr.Filter{
-		Kinds:   []int{KIND_BOOKMARKS},
-		Authors: []string{s.RelayPubkey},
-	}
-
-	bookMarkEvts, err := getLocalEvents(bookmarkFilter)
-	if err != nil {
-		log.Printf("[ERROR] GetLocalEvent %s", err)
-		return []models.GUIEntry{}, err
-	}
-
-	localEntries := make([]models.GUIEntry, 0)
-	if len(bookMarkEvts) > 0 {
-		bookMarkTags = bookMarkEvts[0].Tags.GetAll([]string{s.RsslayTagKey})
-		for _, tag := range bookMarkTags {
-
-			if err := json.Unmarshal([]byte(tag.Value()), &rsslayEntity); err != nil {
-				log.Printf("[ERROR] %s", err)
-			}
-
-			npub, _ := nip19.EncodePublicKey(rsslayEntity.PubKey)
-			localEntries = append(localEntries, models.GUIEntry{
-				BookmarkEntity: models.Entity{
-					PubKey:       rsslayEntity.PubKey,
-					URL:          rsslayEntity.URL,
-					ImageURL:     rsslayEntity.ImageURL,
-					LastPostTime: rsslayEntity.LastPostTime},
-				NPubKey: npub,
-			})
-		}
-	} else {
-		log.Printf("[DEBUG] no saved feedURL entries")
-	}
-	return localEntries, nil
-}
-
-func GetSavedEntity(pubkeyHex string) (models.Entity, error) {
-	var bookMarkTags nostr.Tags
-	var rsslayEntity models.Entity
-
-	var bookmarkFilter nostr.Filter = nostr.Filter{
-		Kinds:   []int{KIND_BOOKMARKS},
-		Authors: []string{s.RelayPubkey},
-	}
-
-	bookMarkEvts, err := getLocalEvents(bookmarkFilter)
-	if err != nil {
-		log.Printf("[ERROR] GetLocalEvent %s", err)
-		return models.Entity{}, err
-	}
-
-	if len(bookMarkEvts) > 0 {
-		bookMarkTags = bookMarkEvts[0].Tags.GetAll([]string{s.RsslayTagKey})
-		for _, tag := range bookMarkTags {
-			if strings.Contains(tag.Value(), pubkeyHex) {
-				if err := json.Unmarshal([]byte(tag.Value()), &rsslayEntity); err != nil {
-					log.Printf("[ERROR] %s", err)
-					return models.Entity{}, err
-				}
-				return rsslayEntity, nil
-			}
-		}
-	}
-
-	log.Printf("[DEBUG] feed entity not found")
-	return models.Entity{}, nil
-}
-
-func GetSavedEntities() ([]models.Entity, error) {
-	var bookMarkTags nostr.Tags
-	var rsslayEntity models.Entity
-
-	var bookmarkFilter nostr.Filter = nostr.Filter{
-		Kinds:   []int{KIND_BOOKMARKS},
-		Authors: []string{s.RelayPubkey},
-	}
-
-	bookMarkEvts, err := getLocalEvents(bookmarkFilter)
-	if err != nil {
-		log.Printf("[ERROR] GetLocalEvent %s", err)
-		return []models.Entity{}, err
-	}
-
-	var entities = make([]models.Entity, 0)
-	if len(bookMarkEvts) > 0 {
-		bookMarkTags = bookMarkEvts[0].Tags.GetAll([]string{s.RsslayTagKey})
-		for _, tag := range bookMarkTags {
-			if err := json.Unmarshal([]byte(tag.Value()), &rsslayEntity); err != nil {
-				log.Printf("[ERROR] %s", err)
-			}
-			entities = append(entities, rsslayEntity)
-		}
-	} else {
-		log.Printf("[DEBUG] feed entity not found")
-	}
-	return entities, nil
-}
-
-func deleteLocalEvents(filter nostr.Filter) error {
+func deleteStoredEvents(events []*nostr.Event) {
 	ctx := context.TODO()
-
-	ch, err := db.QueryEvents(ctx, filter)
-	if err != nil {
-		log.Printf("[ERROR] QueryEvents: %s", err)
-		return err
-	}
-
-	events := make([]*nostr.Event, 0)
-
-	for evt := range ch {
-		events = append(events, evt)
-	}
-
-	if len(events) < 1 {
-		log.Print("[DEBUG] no events found")
-		return nil
-	}
-
 	for _, evnt := range events {
 
 		switch evnt.Kind {
@@ -553,6 +211,8 @@ func deleteLocalEvents(filter nostr.Filter) error {
 			metrics.KindProfileMetadatasDeleted.Inc()
 		case KIND_BOOKMARKS:
 			metrics.KindBookmarkNotesDeleted.Inc()
+		case KIND_LONG_FORM:
+			metrics.KindLongFormDeleted.Inc()
 		}
 
 		for _, del := range rly.DeleteEvent {
@@ -561,11 +221,10 @@ func deleteLocalEvents(filter nostr.Filter) error {
 			}
 		}
 	}
-
-	log.Printf("[DEBUG] %v events deleted", len(events))
-	return nil
 }
 
+// DeleteOldKindTextNoteEvents deletes notes older than MaxNoteAgeDays. Unless
+// RetractExpiredNotes is off, the feeds also ask other relays to delete them.
 func DeleteOldKindTextNoteEvents() {
 	if s.MaxNoteAgeDays < 1 {
 		log.Printf("[INFO] MaxAgeDays disabled")
@@ -586,40 +245,36 @@ func DeleteOldKindTextNoteEvents() {
 		},
 	}
 
-	if err := deleteLocalEvents(filter); err != nil {
-		log.Printf("[ERROR] delete old notes: %s", err)
-		return
-	}
-}
-
-func deleteOldKBookmarkEvents() {
-	if s.MaxBookmarkAgeHrs < 1 {
-		log.Printf("[INFO] MaxBookmarkAgeHrs disabled")
-		return
+	privateKeys := make(map[string]string)
+	if s.RetractExpiredNotes {
+		privateKeys = feedPrivateKeys(true)
 	}
 
-	maxAgeSecs := nostr.Timestamp(s.MaxBookmarkAgeHrs * 60 * 60)
-	oldAge := nostr.Now() - maxAgeSecs
-	if oldAge <= 0 {
-		log.Printf("[WARN] MaxBookmarkAgeHrs too large")
+	if err := retractEvents(filter, privateKeys, "expired"); err != nil {
+		log.Printf("[ERROR] delete old notes: %s", err)
 		return
 	}
 
-	filter := nostr.Filter{
+	// the deletion requests themselves expire only here
+	if err := deleteLocalEvents(nostr.Filter{
 		Until: &oldAge,
-		Limit: 10,
-		Kinds: []int{
-			KIND_BOOKMARKS,
-		},
-	}
-
-	if err := deleteLocalEvents(filter); err != nil {
-		log.Printf("[ERROR] delete old notes: %s", err)
-		return
+		Kinds: []int{nostr.KindDeletion},
+	}); err != nil {
+		log.Printf("[ERROR] delete old deletion requests: %s", err)
 	}
 }
 
+// followListMu serializes follow list updates from the control loop and the
+// feed workers.
+var followListMu sync.Mutex
+
+// UpdateFollowListEvent publishes the kind-3 follow list of the relay pubkey
+// and brings the follow sets of the feed categories in line.
 func UpdateFollowListEvent(followAction models.FollowManagment) {
+	followListMu.Lock()
+	defer followListMu.Unlock()
+	defer syncFollowSets()
+
 	var currentOneHopNetwork []nostr.Tag
 
 	switch followAction.Action {
@@ -661,24 +316,7 @@ func UpdateFollowListEvent(followAction models.FollowManagment) {
 		}
 	}
 
-	// blastEvent(&evtNewSubs)
+	replicateEvents(evtNewSubs)
 
 	log.Print("[DEBUG] 🫂 new follow list size: ", len(currentOneHopNetwork))
 }
-
-func BlastEvent(ev *nostr.Event) {
-	ctx := context.Background()
-	for _, url := range seedRelays {
-		ctx, cancel := context.WithTimeout(ctx, time.Second*5)
-		relay, err := pool.EnsureRelay(url)
-		if err != nil {
-			cancel()
-			log.Printf("[ERROR] %s", err)
-			continue
-		}
-		relay.Publish(ctx, *ev)
-		cancel()
-	}
-	metrics.NotesBlasted.Inc()
-	log.Print("[INFO] 🔫 blasted event ID ", ev.ID, "to ", len(seedRelays), " relays")
-}
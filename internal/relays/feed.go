@@ -1,117 +1,114 @@
 package relays
 
 import (
+	"bytes"
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"html"
 	"log"
 	"net/url"
 	"rssnotes/internal/helpers"
 	"rssnotes/internal/models"
+	"rssnotes/internal/yarr/yarrparser"
+	"rssnotes/internal/yarr/yarrworker"
 	"rssnotes/metrics"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
-	md "github.com/JohannesKaufmann/html-to-markdown"
-	"github.com/microcosm-cc/bluemonday"
-	"github.com/mmcdole/gofeed"
 	"github.com/nbd-wtf/go-nostr"
 )
 
-func ParseFeedForUrl(url string) (*gofeed.Feed, error) {
+// feedDeleteMu keeps DeleteEntity from removing a feed while a check
+// publishes its items. Checks hold the read lock, deletes the write lock.
+var feedDeleteMu sync.RWMutex
+
+func ParseFeedForUrl(url string) (*yarrparser.Feed, error) {
+	feed, _, err := parseFeedForUrlConditional(url, "", "")
+	return feed, err
+}
+
+// parseFeedForUrlConditional only parses the feed when the server reports a
+// change since lastModified/etag. A nil feed with a NotModified response
+// means nothing new.
+func parseFeedForUrlConditional(url, lastModified, etag string) (*yarrparser.Feed, *yarrworker.FeedResponse, error) {
 	//metrics.CacheMiss.Inc()
 
-	fp := gofeed.NewParser()
-	fp.RSSTranslator = helpers.NewCustomTranslator()
+	res, err := yarrworker.GetFeed(url, lastModified, etag)
+	if err != nil {
+		log.Print("[ERROR] ", err)
+		return nil, nil, err
+	} else if res.NotModified {
+		metrics.FeedsNotModified.Inc()
+		log.Printf("[DEBUG] feed %s not modified", url)
+		return nil, res, nil
+	}
 
-	feed, err := fp.ParseURL(url)
+	feed, err := yarrparser.ParseAndFix(bytes.NewReader(res.Body), url, res.Charset)
 	if err != nil {
 		log.Print("[ERROR] ", err)
-		return nil, err
-	} else if feed == nil {
-		log.Print("[DEBUG] no parse feed returned.")
-		return nil, nil
+		return nil, nil, fmt.Errorf("%w: %w", errFeedParse, err)
 	}
 
-	// cleanup
-	for i := range feed.Items {
-		feed.Items[i].Content = ""
+	if feed.FeedURL == "" {
+		feed.FeedURL = url
 	}
 
-	return feed, nil
+	return feed, res, nil
 }
 
-func parseFeedForPubkey(pubKey string, deleteFailingFeeds bool) (*gofeed.Feed, models.Entity) {
+func parseFeedForPubkey(pubKey string, deleteFailingFeeds bool) (*yarrparser.Feed, *yarrworker.FeedResponse, models.Entity) {
 	pubKey = strings.TrimSpace(pubKey)
 
 	entity, err := GetSavedEntity(pubKey)
 	if err != nil {
 		log.Printf("[ERROR] failed to retrieve entity with pubkey '%s': %v", pubKey, err)
 		//metrics.AppErrors.With(prometheus.Labels{"type": "SQL_SCAN"}).Inc()
-		return nil, entity
+		return nil, nil, entity
 	}
 
 	if !helpers.IsValidHttpUrl(entity.URL) {
 		log.Printf("[INFO] invalid url %q", entity.URL)
-		// if deleteFailingFeeds {
-		// }
-		return nil, entity
+		recordFeedFailure(entity, models.FeedErrorURL, fmt.Errorf("invalid url %q", entity.URL), deleteFailingFeeds)
+		return nil, nil, entity
 	}
 
-	parsedFeed, err := ParseFeedForUrl(entity.URL)
+	parsedFeed, res, err := parseFeedForUrlConditional(entity.URL, entity.LastModified, entity.ETag)
 	if err != nil {
 		log.Printf("[ERROR] failed to parse feed at url %q: %v", entity.URL, err)
-		if deleteFailingFeeds {
-			// TODO: think
-			// if err := deleteEntityInBookmarkEvent(entity.PublicKey); err != nil {
-			// 	log.Printf("[ERROR] could not delete feed '%q'...Error: %s ", entity.URL, err)
-			// } else {
-			// 	followAction := FollowManagment{
-			// 		Action:       Delete,
-			// 		FollowEntity: Entity{PublicKey: entity.PublicKey},
-			// 	}
-			//log.Printf("[INFO] Deleteing failed feed %s", entity.URL)
-			// 	followManagmentCh <- followAction
-			// }
-		}
-		return nil, entity
+		recordFeedFailure(entity, classifyFeedError(err), err, deleteFailingFeeds)
+		return nil, nil, entity
 	}
-	return parsedFeed, entity
+	return parsedFeed, res, entity
 }
 
-func CreateMetadataNote(pubkey string, privkey string, feed *gofeed.Feed, profilePictureUrl string) error {
-	if _, feedMetadata, _ := getLocalMetadataEvent(pubkey); feedMetadata.ID != "" {
+func CreateMetadataNote(pubkey string, privkey string, feed *yarrparser.Feed, profilePictureUrl string) error {
+	// a retired profile, from before the feed was added again, has no proxy tag
+	if _, feedMetadata, _ := getLocalMetadataEvent(pubkey); feedMetadata.ID != "" && feedMetadata.Tags.GetFirst([]string{"proxy"}) != nil {
 		if time.Now().Unix()-feedMetadata.CreatedAt.Time().Unix() < int64(s.FeedMetadataRefreshDays*86400) {
 			//log.Printf("[DEBUG] recent metadata exists at event ID %s created at: %v", feedMetadata.ID, feedMetadata.CreatedAt.Time().Unix())
 			return nil
 		}
 	}
 
-	var theDescription = feed.Description
-	var theFeedTitle = feed.Title
-	if strings.Contains(feed.Link, "reddit.com") {
-		var subredditParsePart1 = strings.Split(feed.Link, "/r/")
-		var subredditParsePart2 = strings.Split(subredditParsePart1[1], "/")
-		theDescription = feed.Description + fmt.Sprintf(" #%s", subredditParsePart2[0])
-
-		theFeedTitle = "/r/" + subredditParsePart2[0]
+	profile := feedProfile(feed)
+	if profilePictureUrl != "" {
+		profile.Picture = profilePictureUrl
+	} else if profile.Picture == "" {
+		profile.Picture = s.DefaultProfilePicUrl
 	}
+
 	metadata := map[string]string{
-		"name":  theFeedTitle + " (RSS Feed)",
-		"about": theDescription + "\n\n" + feed.Link,
+		"name":    profile.Name + " (RSS Feed)",
+		"about":   profile.About + "\n\n" + profile.Website,
+		"picture": profile.Picture,
 	}
-
-	if profilePictureUrl != "" {
-		metadata["picture"] = profilePictureUrl
-	} else if feed.Image != nil {
-		metadata["picture"] = feed.Image.URL
-	} else {
-		metadata["picture"] = s.DefaultProfilePicUrl
+	if nip05 := nip05IdentifierOf(pubkey); nip05 != "" {
+		metadata["nip05"] = nip05
 	}
 
 	content, err := json.Marshal(metadata)
@@ -126,7 +123,7 @@ func CreateMetadataNote(pubkey string, privkey string, feed *gofeed.Feed, profil
 		PubKey:    pubkey,
 		CreatedAt: nostr.Timestamp(createdAt),
 		Kind:      nostr.KindProfileMetadata,
-		Tags:      nostr.Tags{[]string{"proxy", feed.FeedLink, "rss"}},
+		Tags:      nostr.Tags{[]string{"proxy", feed.FeedURL, "rss"}},
 		Content:   string(content),
 	}
 	evt.ID = string(evt.Serialize())
@@ -141,86 +138,54 @@ func CreateMetadataNote(pubkey string, privkey string, feed *gofeed.Feed, profil
 	for _, store := range rly.StoreEvent {
 		store(context.TODO(), &evt)
 	}
+	replicateEvents(evt)
 
 	metrics.KindProfileMetadataCreated.Inc()
-	log.Printf("[DEBUG] metadata note for %s created with ID %s with createdat %d", feed.Link, evt.ID, evt.CreatedAt.Time().Unix())
+	log.Printf("[DEBUG] metadata note for %s created with ID %s with createdat %d", feed.SiteURL, evt.ID, evt.CreatedAt.Time().Unix())
 	return nil
 }
 
-func feedItemToNote(pubkey string, item *gofeed.Item, feed *gofeed.Feed, defaultCreatedAt time.Time, _ string, maxContentLength int) nostr.Event {
-	content := ""
-	if item.Title != "" {
-		content = "**" + item.Title + "**"
-	}
-
-	mdConverter := md.NewConverter("", true, nil)
-	mdConverter.AddRules(helpers.GetConverterRules()...)
+func feedItemToNote(entity models.Entity, item *yarrparser.Item, feed *yarrparser.Feed, defaultCreatedAt time.Time, maxContentLength int) nostr.Event {
+	data := newNoteData(entity, item, feed, maxContentLength)
 
-	description, err := mdConverter.ConvertString(item.Description)
+	content, err := renderNote(noteTemplateFor(entity.NoteTemplate), data)
 	if err != nil {
-		log.Printf("[WARN] failure to convert description to markdown (defaulting to plain text): %v", err)
-		p := bluemonday.StripTagsPolicy()
-		description = p.Sanitize(item.Description)
-	}
-
-	if !strings.EqualFold(item.Title, description) && !strings.Contains(feed.Link, "stacker.news") && !strings.Contains(feed.Link, "reddit.com") {
-		content += "\n\n" + description
-	}
-
-	shouldUpgradeLinkSchema := false
-
-	if strings.Contains(feed.Link, "reddit.com") {
-		var subredditParsePart1 = strings.Split(feed.Link, "/r/")
-		var subredditParsePart2 = strings.Split(subredditParsePart1[1], "/")
-		var theHashtag = fmt.Sprintf(" #%s", subredditParsePart2[0])
-
-		content = content + "\n\n" + theHashtag
-	}
-
-	content = html.UnescapeString(content)
-	if len(content) > maxContentLength {
-		content = content[0:(maxContentLength-1)] + "…"
-	}
-
-	if shouldUpgradeLinkSchema {
-		item.Link = strings.ReplaceAll(item.Link, "http://", "https://")
+		log.Printf("[WARN] note template failed for %s, using the default style: %v", feed.FeedURL, err)
+		tmpl, _ := ParseNoteTemplate(DefaultNoteStyle)
+		content, _ = renderNote(tmpl, data)
 	}
 
-	// Handle comments
-	if item.Custom != nil {
-		if comments, ok := item.Custom["comments"]; ok {
-			content += fmt.Sprintf("\n\nComments: %s", comments)
-		}
+	evt := nostr.Event{
+		PubKey:    entity.PubKey,
+		CreatedAt: nostr.Timestamp(itemCreatedAt(item, defaultCreatedAt).Unix()),
+		Kind:      nostr.KindTextNote,
+		Tags:      append(nostr.Tags{[]string{"proxy", itemProxyLink(item, feed), "rss"}}, hashtagTags(data.Tags)...),
+		Content:   strings.ToValidUTF8(content, ""),
 	}
+	attachMedia(&evt, itemMedia(item, item.Summary+item.Content))
+	evt.ID = string(evt.Serialize())
 
-	content += "\n\n" + item.Link
+	return evt
+}
 
+func itemCreatedAt(item *yarrparser.Item, defaultCreatedAt time.Time) time.Time {
 	createdAt := defaultCreatedAt
-	//log.Printf("[DEBUG] item %s defaultCreatedAt %v", item.Title, defaultCreatedAt.Unix())
-	if item.UpdatedParsed != nil {
-		createdAt = *item.UpdatedParsed
-		//log.Printf("[DEBUG] item %s UpdatedParsed %v", item.Title, item.UpdatedParsed.Unix())
+	if !item.Date.IsZero() {
+		createdAt = item.Date
 	}
-	if item.PublishedParsed != nil {
-		createdAt = *item.PublishedParsed
-		//log.Printf("[DEBUG] item %s PublishedParsed %v", item.Title, item.PublishedParsed.Unix())
+	// future dated items would pin the last post time
+	if createdAt.After(time.Now()) {
+		createdAt = time.Now()
 	}
+	return createdAt
+}
 
-	composedProxyLink := feed.FeedLink
+func itemProxyLink(item *yarrparser.Item, feed *yarrparser.Feed) string {
+	composedProxyLink := feed.FeedURL
 	if item.GUID != "" {
 		composedProxyLink += fmt.Sprintf("#%s", url.QueryEscape(item.GUID))
 	}
-
-	evt := nostr.Event{
-		PubKey:    pubkey,
-		CreatedAt: nostr.Timestamp(createdAt.Unix()),
-		Kind:      nostr.KindTextNote,
-		Tags:      nostr.Tags{[]string{"proxy", composedProxyLink, "rss"}},
-		Content:   strings.ToValidUTF8(content, ""),
-	}
-	evt.ID = string(evt.Serialize())
-
-	return evt
+	return composedProxyLink
 }
 
 func GetPrivateKeyFromFeedUrl(url string, secret string) string {
@@ -230,102 +195,174 @@ func GetPrivateKeyFromFeedUrl(url string, secret string) string {
 	return hex.EncodeToString(r)
 }
 
-func CheckAllFeeds() {
-	newBookmarkCreated := false
-	currentEntities, err := GetSavedEntities()
+// checkFeed fetches a feed and publishes the items that were not seen yet.
+func checkFeed(currentEntity models.Entity) {
+	parsedFeed, res, entity := parseFeedForPubkey(currentEntity.PubKey, s.DeleteFailingFeeds)
+	if res != nil && res.NotModified {
+		if err := UpdateEntity(entity.PubKey, func(e *models.Entity) {
+			e.LastCheckedTime = time.Now().Unix()
+			e.ETag = res.ETag
+			e.LastModified = res.LastModified
+			markFeedHealthy(e)
+		}); err != nil {
+			log.Printf("[ERROR] feed entity %s not updated: %s", entity.URL, err)
+		}
+		return
+	}
+	if parsedFeed == nil {
+		return
+	}
+
+	// the feed may have been deleted while it was fetched
+	feedDeleteMu.RLock()
+	defer feedDeleteMu.RUnlock()
+	if current, err := GetSavedEntity(entity.PubKey); err != nil {
+		return
+	} else if current.PubKey == "" {
+		log.Printf("[DEBUG] feed %s was deleted during its check", entity.URL)
+		return
+	}
+
+	privateKey, err := openPrivateKey(entity)
 	if err != nil {
-		log.Print("[ERROR] could not retrieve entities")
+		log.Printf("[ERROR] could not decrypt private key of %s: %s", entity.URL, err)
+		// backs the feed off instead of checking it again right away, but a
+		// broken key is not the fault of the feed, so it is never retired
+		recordFeedFailure(entity, models.FeedErrorStore, err, false)
 		return
 	}
-	for _, currentEntity := range currentEntities {
-		if !helpers.TimetoUpdateFeed(currentEntity) {
-			//log.Printf("[DEBUG] not time to update %s. Time since last check: %d Avg post time: %d", currentEntity.URL, time.Now().Unix()-currentEntity.LastCheckedTime, currentEntity.AvgPostTime)
-			continue
-		}
 
-		lastPostTime := int64(0)
-		allPostTimes := make([]int64, 0)
+	if err := CreateMetadataNote(currentEntity.PubKey, privateKey, parsedFeed, s.DefaultProfilePicUrl); err != nil {
+		log.Printf("[ERROR] could not create metadata note: %s", err)
+	}
 
-		parsedFeed, entity := parseFeedForPubkey(currentEntity.PubKey, s.DeleteFailingFeeds)
-		if parsedFeed == nil {
-			continue
-		}
+	seenItems, hasSeenItems, err := getSeenItems(entity.PubKey)
+	if err != nil {
+		log.Printf("[ERROR] could not read seen items of %s: %s", entity.URL, err)
+		recordFeedFailure(entity, models.FeedErrorStore, err, false)
+		return
+	}
+
+	entity.PrivateKey = privateKey
+	lastPostTime, allPostTimes := publishFeedItems(entity, parsedFeed, seenItems, hasSeenItems)
+
+	if err := updateEntityTimes(models.Entity{
+		PubKey:          entity.PubKey,
+		Title:           parsedFeed.Title,
+		SiteURL:         parsedFeed.SiteURL,
+		LastPostTime:    lastPostTime,
+		LastCheckedTime: time.Now().Unix(),
+		AvgPostTime:     CalcAvgPostTime(allPostTimes),
+		ETag:            res.ETag,
+		LastModified:    res.LastModified,
+	}); err != nil {
+		log.Printf("[ERROR] feed entity %s not updated", entity.URL)
+	}
+}
+
+// InitFeed publishes every item of a new feed. The entity needs the plain
+// private key.
+func InitFeed(entity models.Entity, parsedFeed *yarrparser.Feed) (int64, []int64) {
+	return publishFeedItems(entity, parsedFeed, map[string]bool{}, true)
+}
 
-		if err := CreateMetadataNote(currentEntity.PubKey, currentEntity.PrivateKey, parsedFeed, s.DefaultProfilePicUrl); err != nil {
-			log.Printf("[ERROR] could not create metadata note: %s", err)
+// publishFeedItems publishes the items that are not in the seen set, in the
+// output mode of the feed, queues them for replication and saves the new
+// seen set. Feeds without a seen set yet fall back to the last post time
+// once.
+func publishFeedItems(entity models.Entity, parsedFeed *yarrparser.Feed, seenItems map[string]bool, hasSeenItems bool) (int64, []int64) {
+	var lastPostTime int64
+	postTimes := make([]int64, 0, len(parsedFeed.Items))
+	itemKeys := make([]string, 0, len(parsedFeed.Items))
+	outgoing := make([]nostr.Event, 0)
+	now := time.Unix(time.Now().Unix(), 0)
+	versioned := versionedItems(seenItems)
+
+	for i := range parsedFeed.Items {
+		item := &parsedFeed.Items[i]
+		createdAt := itemCreatedAt(item, now)
+		itemKey := itemSeenKey(item)
+
+		isNewItem := !seenItems[itemKey]
+		if !hasSeenItems {
+			isNewItem = entity.LastPostTime < createdAt.Unix()
 		}
 
-		for _, item := range parsedFeed.Items {
-			defaultCreatedAt := time.Unix(time.Now().Unix(), 0)
-			evt := feedItemToNote(currentEntity.PubKey, item, parsedFeed, defaultCreatedAt, entity.URL, s.MaxContentLength)
-			if entity.LastPostTime < evt.CreatedAt.Time().Unix() {
-				if err := evt.Sign(entity.PrivateKey); err != nil {
+		switch entity.OutputMode {
+		case models.OutputLongForm, models.OutputLongFormTeaser:
+			// items without a version key yet only get one, they were
+			// published as notes or before versions were tracked
+			versionKey := itemVersionKey(item)
+			isUpdatedItem := hasSeenItems && !isNewItem && versioned[itemKey] && !seenItems[versionKey]
+
+			if isNewItem || isUpdatedItem {
+				articleCreatedAt := createdAt
+				if isUpdatedItem {
+					articleCreatedAt = now
+				}
+				article := feedItemToArticle(entity, item, parsedFeed, articleCreatedAt)
+				if err := publishArticle(&article, entity.PrivateKey); err != nil {
 					log.Printf("[ERROR] %s", err)
 					continue
 				}
-				log.Printf("[DEBUG] feed entity %s note created with ID %s", entity.URL, evt.ID)
-
-				rly.BroadcastEvent(&evt)
-
-				for _, store := range rly.StoreEvent {
-					store(context.TODO(), &evt)
+				log.Printf("[DEBUG] feed entity %s article published with ID %s", entity.URL, article.ID)
+				outgoing = append(outgoing, article)
+
+				if isNewItem && entity.OutputMode == models.OutputLongFormTeaser {
+					teaser := feedItemToTeaser(entity, item, parsedFeed, &article, createdAt, s.MaxContentLength)
+					if err := publishEvent(&teaser, entity.PrivateKey); err != nil {
+						log.Printf("[ERROR] %s", err)
+					} else {
+						metrics.KindTextNoteCreated.Inc()
+						outgoing = append(outgoing, teaser)
+					}
 				}
-
+			}
+			itemKeys = append(itemKeys, versionKey)
+		default:
+			if isNewItem {
+				evt := feedItemToNote(entity, item, parsedFeed, now, s.MaxContentLength)
+				if err := publishEvent(&evt, entity.PrivateKey); err != nil {
+					log.Printf("[ERROR] %s", err)
+					continue
+				}
+				log.Printf("[DEBUG] feed entity %s note created with ID %s", entity.URL, evt.ID)
 				metrics.KindTextNoteCreated.Inc()
+				outgoing = append(outgoing, evt)
 			}
+		}
 
-			if evt.CreatedAt.Time().Unix() > lastPostTime {
-				lastPostTime = evt.CreatedAt.Time().Unix()
-			}
+		itemKeys = append(itemKeys, itemKey)
 
-			allPostTimes = append(allPostTimes, evt.CreatedAt.Time().Unix())
+		if createdAt.Unix() > lastPostTime {
+			lastPostTime = createdAt.Unix()
 		}
+		postTimes = append(postTimes, createdAt.Unix())
+	}
 
-		if err := updateEntityTimesInBookmarkEvent(models.Entity{
-			PubKey:          entity.PubKey,
-			LastPostTime:    lastPostTime,
-			LastCheckedTime: time.Now().Unix(),
-			AvgPostTime:     CalcAvgPostTime(allPostTimes),
-		}); err != nil {
-			log.Printf("[ERROR] feed entity %s not updated", entity.URL)
-		} else {
-			newBookmarkCreated = true
-		}
+	if err := markItemsSeen(entity.PubKey, itemKeys); err != nil {
+		log.Printf("[ERROR] could not save seen items of %s: %s", entity.URL, err)
 	}
-	if newBookmarkCreated {
-		deleteOldKBookmarkEvents()
+	if replicates(entity) {
+		enqueueReplication(outgoing...)
 	}
-}
-
-func InitFeed(pubkey string, privkey string, feedURL string, parsedFeed *gofeed.Feed) (int64, []int64) {
-	var lastPostTime int64
-	postTimes := make([]int64, 0)
-
-	for _, item := range parsedFeed.Items {
-		defaultCreatedAt := time.Unix(time.Now().Unix(), 0)
-		evt := feedItemToNote(pubkey, item, parsedFeed, defaultCreatedAt, feedURL, s.MaxContentLength)
-		if err := evt.Sign(privkey); err != nil {
-			log.Printf("[ERROR] %s", err)
-			continue
-		}
-		log.Printf("[DEBUG] feed entity %s note created with ID %s", feedURL, evt.ID)
 
-		rly.BroadcastEvent(&evt)
+	return lastPostTime, postTimes
+}
 
-		for _, store := range rly.StoreEvent {
-			store(context.TODO(), &evt)
-		}
+// publishEvent signs an event, sends it to the listeners of the relay and
+// stores it.
+func publishEvent(evt *nostr.Event, privateKey string) error {
+	if err := evt.Sign(privateKey); err != nil {
+		return err
+	}
 
-		metrics.KindTextNoteCreated.Inc()
+	rly.BroadcastEvent(evt)
 
-		if evt.CreatedAt.Time().Unix() > lastPostTime {
-			lastPostTime = evt.CreatedAt.Time().Unix()
-		}
-
-		postTimes = append(postTimes, evt.CreatedAt.Time().Unix())
+	for _, store := range rly.StoreEvent {
+		store(context.TODO(), evt)
 	}
-
-	return lastPostTime, postTimes
+	return nil
 }
 
 func CalcAvgPostTime(feedPostTimes []int64) int64 {
@@ -0,0 +1,107 @@
+package relays
+
+import (
+	"log"
+	"slices"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const KIND_FOLLOW_SET int = 30000 //NIP-51
+
+// syncFollowSets publishes a follow set of the relay pubkey for every feed
+// category, with the category as d tag, and retracts the sets of categories
+// no feed is in anymore. Sets that did not change are left alone.
+func syncFollowSets() {
+	entities, err := GetSavedEntities()
+	if err != nil {
+		log.Printf("[ERROR] follow sets: %s", err)
+		return
+	}
+
+	members := make(map[string][]string)
+	for _, entity := range entities {
+		for _, category := range entity.Categories {
+			members[category] = append(members[category], entity.PubKey)
+		}
+	}
+
+	previous, err := getLocalEvents(nostr.Filter{
+		Kinds:   []int{KIND_FOLLOW_SET},
+		Authors: []string{s.RelayPubkey},
+	})
+	if err != nil {
+		return
+	}
+	previousByCategory := make(map[string]*nostr.Event, len(previous))
+	for _, evt := range previous {
+		previousByCategory[evt.Tags.GetD()] = evt
+	}
+
+	stale := make([]string, 0)
+	for category := range previousByCategory {
+		if _, ok := members[category]; !ok {
+			stale = append(stale, category)
+		}
+	}
+	if len(stale) > 0 {
+		privateKeys := make(map[string]string)
+		if s.ReplicateEvents {
+			privateKeys[s.RelayPubkey] = s.RelayPrivkey
+		}
+		if err := retractEvents(nostr.Filter{
+			Kinds:   []int{KIND_FOLLOW_SET},
+			Authors: []string{s.RelayPubkey},
+			Tags:    nostr.TagMap{"d": stale},
+		}, privateKeys, "category removed"); err != nil {
+			log.Printf("[ERROR] retracting follow sets %v: %s", stale, err)
+		}
+	}
+
+	for category, pubkeys := range members {
+		slices.Sort(pubkeys)
+		if err := publishFollowSet(category, pubkeys, previousByCategory[category]); err != nil {
+			log.Printf("[ERROR] follow set %q: %s", category, err)
+		}
+	}
+}
+
+// publishFollowSet stores and replicates the follow set of a category,
+// unless previous already lists the same pubkeys.
+func publishFollowSet(category string, pubkeys []string, previous *nostr.Event) error {
+	if previous != nil {
+		current := make([]string, 0, len(pubkeys))
+		for _, tag := range previous.Tags.GetAll([]string{"p", ""}) {
+			current = append(current, tag.Value())
+		}
+		if slices.Equal(current, pubkeys) {
+			return nil
+		}
+	}
+
+	evt := nostr.Event{
+		PubKey:    s.RelayPubkey,
+		CreatedAt: nostr.Now(),
+		Kind:      KIND_FOLLOW_SET,
+		Tags:      make(nostr.Tags, 0, len(pubkeys)+2),
+	}
+	if previous != nil {
+		evt.CreatedAt = max(evt.CreatedAt, previous.CreatedAt+1)
+	}
+	evt.Tags = append(evt.Tags, nostr.Tag{"d", category}, nostr.Tag{"title", category})
+	for _, pubkey := range pubkeys {
+		evt.Tags = append(evt.Tags, nostr.Tag{"p", pubkey, PublicRelayURL()})
+	}
+	if err := evt.Sign(s.RelayPrivkey); err != nil {
+		return err
+	}
+
+	if previous != nil {
+		deleteStoredEvents([]*nostr.Event{previous})
+	}
+	storeLocalEvent(&evt)
+	replicateEvents(evt)
+
+	log.Printf("[DEBUG] follow set %q has %d feeds", category, len(pubkeys))
+	return nil
+}
@@ -0,0 +1,78 @@
+package relays
+
+import (
+	"rssnotes/internal/models"
+	"rssnotes/internal/yarr/yarrparser"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const maxHashtagLength = 64
+
+// NormalizeHashtag lowercases a category and drops everything but letters,
+// digits and underscores, so "Open Source" and "open-source" both become
+// "opensource".
+func NormalizeHashtag(category string) string {
+	tag := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, strings.TrimPrefix(strings.TrimSpace(category), "#"))
+
+	if len([]rune(tag)) > maxHashtagLength {
+		return ""
+	}
+	return tag
+}
+
+// itemHashtags returns the normalized categories of an item, filtered by the
+// allow and deny lists of the feed.
+func itemHashtags(entity models.Entity, item *yarrparser.Item) []string {
+	hashtags := make([]string, 0, len(item.Categories))
+	for _, category := range item.Categories {
+		tag := NormalizeHashtag(category)
+		if tag == "" || slices.Contains(hashtags, tag) {
+			continue
+		}
+		if len(entity.HashtagAllow) > 0 && !slices.Contains(entity.HashtagAllow, tag) {
+			continue
+		}
+		if slices.Contains(entity.HashtagDeny, tag) {
+			continue
+		}
+		hashtags = append(hashtags, tag)
+	}
+	return hashtags
+}
+
+// capHashtags keeps the first MaxHashtags hashtags.
+func capHashtags(hashtags []string) []string {
+	if s.MaxHashtags >= 0 && len(hashtags) > s.MaxHashtags {
+		return hashtags[:s.MaxHashtags]
+	}
+	return hashtags
+}
+
+func hashtagTags(hashtags []string) nostr.Tags {
+	tags := make(nostr.Tags, 0, len(hashtags))
+	for _, hashtag := range hashtags {
+		tags = append(tags, nostr.Tag{"t", hashtag})
+	}
+	return tags
+}
+
+// NormalizeHashtagList turns a comma or space separated list into
+// normalized hashtags.
+func NormalizeHashtagList(list string) []string {
+	hashtags := make([]string, 0)
+	for _, field := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		if tag := NormalizeHashtag(field); tag != "" && !slices.Contains(hashtags, tag) {
+			hashtags = append(hashtags, tag)
+		}
+	}
+	return hashtags
+}
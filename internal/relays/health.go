@@ -0,0 +1,91 @@
+package relays
+
+import (
+	"errors"
+	"log"
+	"net"
+	"rssnotes/internal/models"
+	"rssnotes/internal/yarr/yarrworker"
+	"rssnotes/metrics"
+	"time"
+)
+
+// errFeedParse wraps errors of feeds that downloaded but did not parse.
+var errFeedParse = errors.New("feed parse")
+
+// maxBackoffShift keeps the exponential backoff from overflowing.
+const maxBackoffShift = 16
+
+func classifyFeedError(err error) models.FeedErrorClass {
+	var dnsErr *net.DNSError
+	var statusErr *yarrworker.HTTPStatusError
+
+	switch {
+	case err == nil:
+		return models.FeedErrorNone
+	case errors.Is(err, errFeedParse):
+		return models.FeedErrorParse
+	case errors.As(err, &statusErr):
+		return models.FeedErrorHTTP
+	case errors.As(err, &dnsErr):
+		return models.FeedErrorDNS
+	}
+	return models.FeedErrorNetwork
+}
+
+// feedBackoffSecs doubles the check interval of a feed for every failure in
+// a row, up to MaxFeedBackoffHrs.
+func feedBackoffSecs(entity models.Entity, failures int) int64 {
+	base := max(entity.AvgPostTime, int64(s.FeedItemsRefreshMinutes*60))
+	maxBackoff := max(s.MaxFeedBackoffHrs*3600, base)
+
+	backoff := base << min(failures, maxBackoffShift)
+	if backoff <= 0 || backoff > maxBackoff {
+		return maxBackoff
+	}
+	return backoff
+}
+
+// markFeedHealthy resets the failure streak of a feed that was checked
+// successfully.
+func markFeedHealthy(entity *models.Entity) {
+	entity.ConsecutiveFailures = 0
+	entity.LastErrorClass = models.FeedErrorNone
+	entity.LastError = ""
+	entity.BackoffSecs = 0
+	entity.LastSuccessTime = time.Now().Unix()
+}
+
+// recordFeedFailure extends the failure streak of a feed and retires it
+// once the streak reaches FailingFeedStreak, if deleteFailingFeeds is set.
+// Retired feeds are only deleted here, other relays keep their events.
+func recordFeedFailure(entity models.Entity, class models.FeedErrorClass, feedErr error, deleteFailingFeeds bool) {
+	metrics.FeedsFailed.Inc()
+
+	var failures int
+	if err := UpdateEntity(entity.PubKey, func(e *models.Entity) {
+		e.ConsecutiveFailures++
+		e.LastErrorClass = class
+		e.LastError = feedErr.Error()
+		e.BackoffSecs = feedBackoffSecs(*e, e.ConsecutiveFailures)
+		e.LastCheckedTime = time.Now().Unix()
+		failures = e.ConsecutiveFailures
+	}); err != nil {
+		log.Printf("[ERROR] could not record failure of feed %s: %s", entity.URL, err)
+		return
+	}
+	log.Printf("[DEBUG] feed %s failed %d times in a row (%s)", entity.URL, failures, class)
+
+	if !deleteFailingFeeds || failures < s.FailingFeedStreak {
+		return
+	}
+
+	if err := DeleteEntity(entity.PubKey, true); err != nil {
+		log.Printf("[ERROR] could not delete failing feed %s: %s", entity.URL, err)
+		return
+	}
+	UpdateFollowListEvent(models.FollowManagment{Action: models.Sync})
+
+	metrics.FeedsRetired.Inc()
+	log.Printf("[INFO] deleted feed %s after %d failed checks", entity.URL, failures)
+}
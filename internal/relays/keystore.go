@@ -0,0 +1,63 @@
+package relays
+
+import (
+	"fmt"
+	"log"
+	"rssnotes/internal/config"
+	"rssnotes/internal/models"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip44"
+)
+
+// feed private keys are stored nip44 encrypted to the relay key, or to
+// KEY_ENCRYPTION_PRIVKEY when it is set
+var feedKeyConversationKey [32]byte
+
+func initKeyEncryption(cfg config.C) error {
+	masterPrivkey := cfg.RelayPrivkey
+	if cfg.KeyEncryptionPrivkey != "" {
+		masterPrivkey = cfg.KeyEncryptionPrivkey
+	}
+
+	masterPubkey, err := nostr.GetPublicKey(masterPrivkey)
+	if err != nil {
+		return fmt.Errorf("key encryption pubkey: %w", err)
+	}
+
+	feedKeyConversationKey, err = nip44.GenerateConversationKey(masterPubkey, masterPrivkey)
+	if err != nil {
+		return fmt.Errorf("key encryption conversation key: %w", err)
+	}
+	return nil
+}
+
+// sealPrivateKey moves a plain text PrivateKey into EncryptedPrivateKey.
+func sealPrivateKey(entity *models.Entity) error {
+	if entity.PrivateKey == "" {
+		return nil
+	}
+
+	encrypted, err := nip44.Encrypt(entity.PrivateKey, feedKeyConversationKey)
+	if err != nil {
+		return err
+	}
+
+	entity.EncryptedPrivateKey = encrypted
+	entity.PrivateKey = ""
+	return nil
+}
+
+// openPrivateKey returns the plain text private key of a stored entity. The
+// result must only be held in memory for signing.
+func openPrivateKey(entity models.Entity) (string, error) {
+	if entity.EncryptedPrivateKey == "" {
+		if entity.PrivateKey != "" {
+			log.Printf("[WARN] entity %s has an unencrypted private key", entity.URL)
+			return entity.PrivateKey, nil
+		}
+		return "", fmt.Errorf("entity %s has no private key", entity.URL)
+	}
+
+	return nip44.Decrypt(entity.EncryptedPrivateKey, feedKeyConversationKey)
+}
@@ -0,0 +1,156 @@
+package relays
+
+import (
+	"fmt"
+	"mime"
+	"net/url"
+	"path"
+	"rssnotes/internal/yarr/yarrparser"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// mediaAttachment is a file an item links to, described by a NIP-92 imeta
+// tag.
+type mediaAttachment struct {
+	URL      string
+	MimeType string
+	Size     int64
+	Width    int
+	Height   int
+	Alt      string
+	Inline   bool // found in the item html, only tagged when in the content
+}
+
+func (m mediaAttachment) imetaTag() nostr.Tag {
+	tag := nostr.Tag{"imeta", "url " + m.URL}
+	if m.MimeType != "" {
+		tag = append(tag, "m "+m.MimeType)
+	}
+	if m.Size > 0 {
+		tag = append(tag, fmt.Sprintf("size %d", m.Size))
+	}
+	if m.Width > 0 && m.Height > 0 {
+		tag = append(tag, fmt.Sprintf("dim %dx%d", m.Width, m.Height))
+	}
+	if m.Alt != "" {
+		tag = append(tag, "alt "+m.Alt)
+	}
+	return tag
+}
+
+// itemMedia collects the primary image, the enclosures and the images of
+// the item html, without duplicates.
+func itemMedia(item *yarrparser.Item, itemHTML string) []mediaAttachment {
+	attachments := make([]mediaAttachment, 0, len(item.Enclosures)+1)
+	seen := make(map[string]bool)
+
+	add := func(m mediaAttachment) {
+		if m.URL == "" || seen[m.URL] {
+			return
+		}
+		seen[m.URL] = true
+		m.MimeType = mediaMimeType(m.URL, m.MimeType)
+		attachments = append(attachments, m)
+	}
+
+	add(mediaAttachment{
+		URL:    item.ImageURL,
+		Width:  item.ImageWidth,
+		Height: item.ImageHeight,
+	})
+
+	for _, enclosure := range item.Enclosures {
+		add(mediaAttachment{
+			URL:      enclosure.URL,
+			MimeType: enclosure.Type,
+			Size:     enclosure.Length,
+			Width:    enclosure.Width,
+			Height:   enclosure.Height,
+			Alt:      enclosure.Title,
+		})
+	}
+
+	for _, img := range inlineImages(itemHTML, item.URL) {
+		add(img)
+	}
+
+	return attachments
+}
+
+func inlineImages(itemHTML, baseURL string) []mediaAttachment {
+	if !strings.Contains(itemHTML, "<img") {
+		return nil
+	}
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(itemHTML))
+	if err != nil {
+		return nil
+	}
+
+	images := make([]mediaAttachment, 0)
+	doc.Find("img[src]").Each(func(_ int, img *goquery.Selection) {
+		src := strings.TrimSpace(img.AttrOr("src", ""))
+		if src == "" || strings.HasPrefix(src, "data:") {
+			return
+		}
+		src = resolveItemURL(baseURL, src)
+
+		var width, height int
+		fmt.Sscan(img.AttrOr("width", ""), &width)
+		fmt.Sscan(img.AttrOr("height", ""), &height)
+
+		images = append(images, mediaAttachment{
+			URL:    src,
+			Width:  width,
+			Height: height,
+			Alt:    strings.TrimSpace(img.AttrOr("alt", "")),
+			Inline: true,
+		})
+	})
+	return images
+}
+
+func resolveItemURL(baseURL, rawURL string) string {
+	base, err := url.Parse(baseURL)
+	if err != nil || baseURL == "" {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return base.ResolveReference(u).String()
+}
+
+// mediaMimeType keeps a full mime type, or guesses one from the file
+// extension.
+func mediaMimeType(mediaURL, mimeType string) string {
+	if mimeType != "" && !strings.HasSuffix(mimeType, "/*") {
+		return mimeType
+	}
+
+	if u, err := url.Parse(mediaURL); err == nil {
+		if guessed, _, _ := strings.Cut(mime.TypeByExtension(path.Ext(u.Path)), ";"); guessed != "" {
+			return guessed
+		}
+	}
+	return ""
+}
+
+// attachMedia adds an imeta tag for every attachment, appending the url of
+// enclosures and images that are not in the content yet. Inline images
+// are only tagged when the content kept them.
+func attachMedia(evt *nostr.Event, attachments []mediaAttachment) {
+	for _, m := range attachments {
+		if !strings.Contains(evt.Content, m.URL) {
+			if m.Inline {
+				continue
+			}
+			evt.Content += "\n\n" + m.URL
+		}
+		evt.Tags = append(evt.Tags, m.imetaTag())
+	}
+}
@@ -0,0 +1,332 @@
+package relays
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"rssnotes/internal/models"
+	"slices"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// registryNIP05Prefix keys map a nip05 name to the pubkey of its feed, so
+// that no two feeds get the same name.
+const registryNIP05Prefix byte = 133
+
+// NIP05RelayName is the name of the relay pubkey itself, shown by clients
+// as just the domain.
+const NIP05RelayName = "_"
+
+var (
+	ErrInvalidNIP05Name = errors.New("a nip05 name may only use a-z, 0-9, '-', '_' and '.'")
+	ErrNIP05NameTaken   = errors.New("nip05 name is taken by another feed")
+
+	nip05NameRegex   = regexp.MustCompile(`^[a-z0-9._-]+$`)
+	nip05UnsafeChars = regexp.MustCompile(`[^a-z0-9._-]+`)
+)
+
+// second level labels that are part of the public suffix, like co.uk
+var secondLevelSuffixes = []string{"co", "com", "net", "org", "gov", "edu", "ac", "or", "ne", "go"}
+
+// host labels that say nothing about the site, like feeds.example.com
+var genericHostLabels = []string{"www", "feeds", "feed", "rss", "atom", "blog", "news"}
+
+func registryNIP05Key(name string) []byte {
+	return append([]byte{registryNIP05Prefix}, []byte(name)...)
+}
+
+// NIP05Domain is the domain part of the nip05 identifiers of the feeds.
+func NIP05Domain() string {
+	if s.NIP05Domain != "" {
+		return s.NIP05Domain
+	}
+	u, err := url.Parse(s.RelayURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// NIP05Identifier returns name@domain, or an empty string without a name.
+func NIP05Identifier(name string) string {
+	if name == "" || NIP05Domain() == "" {
+		return ""
+	}
+	return name + "@" + NIP05Domain()
+}
+
+// NormalizeNIP05Name lowercases a name and checks that nip05 allows it.
+func NormalizeNIP05Name(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !nip05NameRegex.MatchString(name) || name == NIP05RelayName {
+		return "", ErrInvalidNIP05Name
+	}
+	return name, nil
+}
+
+// nip05BaseName derives a name from the site of a feed url, so that
+// https://www.theverge.com/rss/index.xml becomes theverge.
+func nip05BaseName(feedUrl string) string {
+	u, err := url.Parse(feedUrl)
+	if err != nil || u.Hostname() == "" {
+		return "feed"
+	}
+
+	labels := strings.Split(strings.ToLower(u.Hostname()), ".")
+	if len(labels) > 1 {
+		labels = labels[:len(labels)-1] // top level domain
+	}
+	if len(labels) > 1 && slices.Contains(secondLevelSuffixes, labels[len(labels)-1]) {
+		labels = labels[:len(labels)-1]
+	}
+	for len(labels) > 1 && slices.Contains(genericHostLabels, labels[0]) {
+		labels = labels[1:]
+	}
+
+	name := strings.Trim(nip05UnsafeChars.ReplaceAllString(labels[len(labels)-1], "-"), "-.")
+	if name == "" {
+		return "feed"
+	}
+	return name
+}
+
+// getNIP05OwnerTxn returns the pubkey that holds a name, or an empty string.
+func getNIP05OwnerTxn(txn *badger.Txn, name string) (string, error) {
+	item, err := txn.Get(registryNIP05Key(name))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		return "", err
+	}
+	return string(val), nil
+}
+
+// freeNIP05NameTxn finds the first of base, base-2, base-3... that is not
+// taken by another feed.
+func freeNIP05NameTxn(txn *badger.Txn, base, pubkeyHex string) (string, error) {
+	for n := 1; ; n++ {
+		name := base
+		if n > 1 {
+			name = fmt.Sprintf("%s-%d", base, n)
+		}
+		owner, err := getNIP05OwnerTxn(txn, name)
+		if err != nil {
+			return "", err
+		}
+		if owner == "" || owner == pubkeyHex {
+			return name, nil
+		}
+	}
+}
+
+// putNIP05NameTxn moves the name index along with the entity, like
+// putEntityTxn does for the url.
+func putNIP05NameTxn(txn *badger.Txn, previous, entity models.Entity) error {
+	if previous.NIP05Name != "" && previous.NIP05Name != entity.NIP05Name {
+		if owner, err := getNIP05OwnerTxn(txn, previous.NIP05Name); err != nil {
+			return err
+		} else if owner == entity.PubKey {
+			if err := txn.Delete(registryNIP05Key(previous.NIP05Name)); err != nil {
+				return err
+			}
+		}
+	}
+	if entity.NIP05Name == "" {
+		return nil
+	}
+
+	owner, err := getNIP05OwnerTxn(txn, entity.NIP05Name)
+	if err != nil {
+		return err
+	} else if owner != "" && owner != entity.PubKey {
+		return ErrNIP05NameTaken
+	}
+	return txn.Set(registryNIP05Key(entity.NIP05Name), []byte(entity.PubKey))
+}
+
+// assignNIP05Name gives a feed that does not hold a name yet the first free
+// name derived from its url, and adds it to the profile.
+func assignNIP05Name(pubkeyHex string) error {
+	var entity models.Entity
+	assigned := false
+	err := updateTxn(func(txn *badger.Txn) error {
+		var err error
+		assigned = false
+		entity, err = getEntityTxn(txn, pubkeyHex)
+		if err != nil {
+			return err
+		}
+
+		base := nip05BaseName(entity.URL)
+		if entity.NIP05Name != "" {
+			// saved without the index, keep the name if it is still free
+			if owner, err := getNIP05OwnerTxn(txn, entity.NIP05Name); err != nil || owner == pubkeyHex {
+				return err
+			}
+			base = entity.NIP05Name
+		}
+
+		if entity.NIP05Name, err = freeNIP05NameTxn(txn, base, pubkeyHex); err != nil {
+			return err
+		}
+		assigned = true
+		return putEntityTxn(txn, entity)
+	})
+	if err != nil || !assigned {
+		return err
+	}
+
+	log.Printf("[DEBUG] feed %s is %s", entity.URL, NIP05Identifier(entity.NIP05Name))
+	if err := updateFeedMetadataNIP05(entity); err != nil {
+		log.Printf("[ERROR] updating nip05 in profile of %s: %s", entity.URL, err)
+	}
+	return nil
+}
+
+// SetNIP05Name overrides the name of a feed. An empty name goes back to the
+// one derived from the feed url.
+func SetNIP05Name(pubkeyHex, name string) error {
+	if name != "" {
+		var err error
+		if name, err = NormalizeNIP05Name(name); err != nil {
+			return err
+		}
+	}
+
+	var entity models.Entity
+	err := db.Update(func(txn *badger.Txn) error {
+		var err error
+		entity, err = getEntityTxn(txn, pubkeyHex)
+		if err != nil {
+			return err
+		}
+
+		if name == "" {
+			if name, err = freeNIP05NameTxn(txn, nip05BaseName(entity.URL), pubkeyHex); err != nil {
+				return err
+			}
+		}
+		entity.NIP05Name = name
+		return putEntityTxn(txn, entity)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := updateFeedMetadataNIP05(entity); err != nil {
+		log.Printf("[ERROR] updating nip05 in profile of %s: %s", entity.URL, err)
+	}
+	return nil
+}
+
+// LookupNIP05Name returns the pubkey of a name, or an empty string.
+func LookupNIP05Name(name string) (string, error) {
+	if name == NIP05RelayName {
+		return s.RelayPubkey, nil
+	}
+
+	var pubkeyHex string
+	err := db.View(func(txn *badger.Txn) error {
+		var err error
+		pubkeyHex, err = getNIP05OwnerTxn(txn, name)
+		return err
+	})
+	return pubkeyHex, err
+}
+
+// nip05IdentifierOf returns the identifier to put in the profile of a
+// pubkey, which is the relay itself or a feed.
+func nip05IdentifierOf(pubkeyHex string) string {
+	if pubkeyHex == s.RelayPubkey {
+		return NIP05Identifier(NIP05RelayName)
+	}
+
+	entity, err := GetSavedEntity(pubkeyHex)
+	if err != nil {
+		return ""
+	}
+	return NIP05Identifier(entity.NIP05Name)
+}
+
+func updateFeedMetadataNIP05(entity models.Entity) error {
+	privateKey, err := openPrivateKey(entity)
+	if err != nil {
+		return err
+	}
+	return updateMetadataNIP05(entity.PubKey, privateKey, NIP05Identifier(entity.NIP05Name))
+}
+
+// updateMetadataNIP05 republishes the stored kind-0 of a pubkey when its
+// nip05 field is out of date. Without a stored kind-0 there is nothing to
+// do, CreateMetadataNote adds the field when it makes one.
+func updateMetadataNIP05(pubkeyHex, privateKey, nip05 string) error {
+	_, previous, err := getLocalMetadataEvent(pubkeyHex)
+	if err != nil || previous.ID == "" {
+		return err
+	}
+
+	metadata := make(map[string]any)
+	if err := json.Unmarshal([]byte(previous.Content), &metadata); err != nil {
+		return err
+	}
+	if current, _ := metadata["nip05"].(string); current == nip05 {
+		return nil
+	}
+	if nip05 == "" {
+		delete(metadata, "nip05")
+	} else {
+		metadata["nip05"] = nip05
+	}
+
+	content, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	evt := nostr.Event{
+		PubKey:    pubkeyHex,
+		CreatedAt: max(nostr.Now(), previous.CreatedAt+1),
+		Kind:      nostr.KindProfileMetadata,
+		Tags:      previous.Tags,
+		Content:   string(content),
+	}
+	if err := evt.Sign(privateKey); err != nil {
+		return err
+	}
+
+	rly.BroadcastEvent(&evt)
+	for _, store := range rly.StoreEvent {
+		store(context.TODO(), &evt)
+	}
+	replicateEvents(evt)
+	return nil
+}
+
+// migrateNIP05Names gives every feed a nip05 name.
+func migrateNIP05Names() error {
+	entities, err := GetSavedEntities()
+	if err != nil {
+		return err
+	}
+
+	for _, entity := range entities {
+		if err := assignNIP05Name(entity.PubKey); err != nil {
+			log.Printf("[ERROR] assigning nip05 name to %s: %s", entity.URL, err)
+		}
+	}
+
+	log.Printf("[INFO] assigned nip05 names to %d feeds", len(entities))
+	return nil
+}
@@ -0,0 +1,236 @@
+package relays
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"rssnotes/internal/helpers"
+	"rssnotes/internal/models"
+	"rssnotes/internal/yarr/yarrparser"
+	"strings"
+	"sync"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+
+	md "github.com/JohannesKaufmann/html-to-markdown"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// NoteStyles are the ready-made note templates. A feed template is either
+// one of these names or the source of a text/template.
+var NoteStyles = map[string]string{
+	"default": `{{with .Title}}**{{.}}**{{end}}
+{{- if .ShowSummary}}
+
+{{truncate .MaxLength .Summary}}{{end}}
+{{- with .Hashtags}}
+
+{{hashtags .}}{{end}}
+{{- with .CommentsURL}}
+
+Comments: {{.}}{{end}}
+
+{{.Link}}`,
+
+	"title-link": `{{.Title}}
+
+{{.Link}}`,
+
+	"markdown": `{{with .Title}}# {{.}}{{end}}
+{{- with .Author}}
+
+by {{.}}{{end}}
+
+{{.Markdown}}
+{{- range .Enclosures}}
+
+[{{or .Title .Type "enclosure"}}]({{.URL}}){{end}}
+{{- with .Hashtags}}
+
+{{hashtags .}}{{end}}
+
+{{.Link}}`,
+
+	"plain": `{{.Title}}
+{{- with .Text}}
+
+{{truncate $.MaxLength .}}{{end}}
+
+{{.Link}}`,
+}
+
+// DefaultNoteStyle is used when neither the feed nor NOTE_TEMPLATE pick one.
+const DefaultNoteStyle = "default"
+
+// NoteData is what note templates render.
+type NoteData struct {
+	Title       string
+	Summary     string // markdown of the summary, or of the content without one
+	Markdown    string // markdown of the content, or of the summary without one
+	Text        string // plain text of the content
+	Link        string
+	CommentsURL string
+	Author      string
+	Authors     []string
+	Categories  []string
+	Tags        []string // normalized hashtags, sent as t tags
+	Hashtags    []string // hashtags to write out: all tags when the feed appends them, or those a site adapter picks
+	Enclosures  []yarrparser.Enclosure
+	FeedTitle   string
+	SiteURL     string
+	ShowSummary bool // false when the summary only repeats the title
+	MaxLength   int
+}
+
+var noteTemplateFuncs = template.FuncMap{
+	"truncate": truncateText,
+	"hashtags": func(tags []string) string {
+		hashtags := make([]string, 0, len(tags))
+		for _, tag := range tags {
+			if tag = NormalizeHashtag(tag); tag != "" {
+				hashtags = append(hashtags, "#"+tag)
+			}
+		}
+		return strings.Join(hashtags, " ")
+	},
+	"join": strings.Join,
+}
+
+var noteTemplateCache sync.Map // template source -> *template.Template
+
+// ParseNoteTemplate resolves a style name or parses a template source.
+func ParseNoteTemplate(nameOrSource string) (*template.Template, error) {
+	source := nameOrSource
+	if style, ok := NoteStyles[nameOrSource]; ok {
+		source = style
+	}
+
+	if tmpl, ok := noteTemplateCache.Load(source); ok {
+		return tmpl.(*template.Template), nil
+	}
+
+	tmpl, err := template.New("note").Funcs(noteTemplateFuncs).Option("missingkey=error").Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("note template: %w", err)
+	}
+	noteTemplateCache.Store(source, tmpl)
+	return tmpl, nil
+}
+
+// noteTemplateFor picks the feed template, the configured one or the default
+// style, in that order.
+func noteTemplateFor(feedTemplate string) *template.Template {
+	for _, nameOrSource := range []string{feedTemplate, s.NoteTemplate} {
+		if nameOrSource == "" {
+			continue
+		}
+		tmpl, err := ParseNoteTemplate(nameOrSource)
+		if err == nil {
+			return tmpl
+		}
+		log.Printf("[WARN] %s, falling back", err)
+	}
+
+	tmpl, _ := ParseNoteTemplate(DefaultNoteStyle)
+	return tmpl
+}
+
+func renderNote(tmpl *template.Template, data NoteData) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+func newNoteData(entity models.Entity, item *yarrparser.Item, feed *yarrparser.Feed, maxContentLength int) NoteData {
+	summaryHTML := firstNonEmpty(item.Summary, item.Content)
+	contentHTML := firstNonEmpty(item.Content, item.Summary)
+
+	data := NoteData{
+		Title:       html.UnescapeString(item.Title),
+		Summary:     html.UnescapeString(toMarkdown(summaryHTML, item.URL)),
+		Markdown:    html.UnescapeString(toMarkdown(contentHTML, item.URL)),
+		Text:        html.UnescapeString(strings.TrimSpace(bluemonday.StripTagsPolicy().Sanitize(contentHTML))),
+		Link:        item.URL,
+		CommentsURL: item.CommentsURL,
+		Categories:  item.Categories,
+		Enclosures:  item.Enclosures,
+		FeedTitle:   feed.Title,
+		SiteURL:     feed.SiteURL,
+		MaxLength:   maxContentLength,
+	}
+
+	authors := item.Authors
+	if len(authors) == 0 {
+		authors = feed.Authors
+	}
+	for _, author := range authors {
+		if name := firstNonEmpty(author.Name, author.Email); name != "" {
+			data.Authors = append(data.Authors, name)
+		}
+	}
+	if len(data.Authors) > 0 {
+		data.Author = data.Authors[0]
+	}
+
+	data.ShowSummary = !strings.EqualFold(item.Title, data.Summary)
+	data.Tags = itemHashtags(entity, item)
+
+	siteAdapterFor(feed).Note(item, feed, &data)
+
+	data.Tags = capHashtags(data.Tags)
+	if entity.AppendHashtags {
+		data.Hashtags = data.Tags
+	}
+
+	return data
+}
+
+// toMarkdown converts item html, resolving relative links and images
+// against the item url.
+func toMarkdown(htmlText, baseURL string) string {
+	mdConverter := md.NewConverter("", true, &md.Options{
+		GetAbsoluteURL: func(_ *goquery.Selection, rawURL string, _ string) string {
+			return resolveItemURL(baseURL, rawURL)
+		},
+	})
+	mdConverter.AddRules(helpers.GetConverterRules()...)
+
+	markdown, err := mdConverter.ConvertString(htmlText)
+	if err != nil {
+		log.Printf("[WARN] failure to convert description to markdown (defaulting to plain text): %v", err)
+		return bluemonday.StripTagsPolicy().Sanitize(htmlText)
+	}
+	return markdown
+}
+
+// truncateText shortens text to at most maxRunes runes, cutting at a word
+// boundary when one is close enough and marking the cut with an ellipsis.
+func truncateText(maxRunes int, text string) string {
+	if maxRunes <= 0 || utf8.RuneCountInString(text) <= maxRunes {
+		return text
+	}
+
+	runes := []rune(text)[:maxRunes-1]
+	cut := len(runes)
+	for i := len(runes) - 1; i > len(runes)*3/4; i-- {
+		if unicode.IsSpace(runes[i]) {
+			cut = i
+			break
+		}
+	}
+
+	return strings.TrimRightFunc(string(runes[:cut]), unicode.IsSpace) + "…"
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,574 @@
+package relays
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"rssnotes/internal/models"
+	"rssnotes/metrics"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// registryOutboxPrefix keys hold the events waiting to be replicated, per
+// seed relay and ordered by the time of their next attempt.
+const registryOutboxPrefix byte = 134
+
+const (
+	outboxBatchSize        = 100
+	outboxMaxAttempts      = 12
+	outboxMaxAge           = 72 * time.Hour // also for relays that are down
+	outboxRetryBase        = 30 * time.Second
+	outboxMaxRetry         = 6 * time.Hour
+	outboxMaxRelayBackoff  = 30 * time.Minute
+	outboxIdlePoll         = time.Minute
+	outboxPublishTimeout   = 10 * time.Second
+	outboxConnectTimeout   = 15 * time.Second
+	outboxNoticeBufferSize = 8
+)
+
+// OK messages with these prefixes will not change on a retry, see NIP-01.
+var permanentRejections = []string{"blocked:", "invalid:", "pow:", "restricted:", "mute:", "auth-required:"}
+
+type outboxEntry struct {
+	Event     nostr.Event
+	Queued    int64
+	Attempts  int
+	LastError string `json:",omitempty"`
+}
+
+// outboxWorker replicates the outbox of one seed relay over its own
+// connection, so that notices can be told apart from other traffic.
+type outboxWorker struct {
+	url     string
+	wake    chan struct{}
+	notices chan string
+	relay   *nostr.Relay
+	cancel  context.CancelFunc
+	backoff time.Duration
+	retryAt time.Time // no connection attempts before, after failed ones
+}
+
+var (
+	outboxMu      sync.Mutex
+	outboxWorkers = make(map[string]*outboxWorker)
+	outboxCtx     context.Context
+	outboxCancel  context.CancelFunc
+	outboxDone    sync.WaitGroup
+)
+
+func outboxRelayPrefix(url string) []byte {
+	return append(append([]byte{registryOutboxPrefix}, []byte(url)...), 0)
+}
+
+func outboxKey(url string, nextAttempt int64, eventID string) []byte {
+	key := binary.BigEndian.AppendUint64(outboxRelayPrefix(url), uint64(nextAttempt))
+	return append(key, []byte(eventID)...)
+}
+
+// replicates tells whether the events of a feed go to the seed relays.
+func replicates(entity models.Entity) bool {
+	return s.ReplicateEvents && !entity.LocalOnly
+}
+
+// replicatesPubkey is replicates for any pubkey of the relay. Pubkeys that
+// are not a feed, like the relay pubkey, follow REPLICATE_EVENTS.
+func replicatesPubkey(pubkeyHex string) bool {
+	if pubkeyHex == s.RelayPubkey {
+		return s.ReplicateEvents
+	}
+	entity, err := GetSavedEntity(pubkeyHex)
+	return err == nil && replicates(entity)
+}
+
+// replicateEvents queues the events of replicated pubkeys for the seed
+// relays.
+func replicateEvents(evts ...nostr.Event) {
+	replicated := make(map[string]bool)
+	outgoing := make([]nostr.Event, 0, len(evts))
+	for _, evt := range evts {
+		ok, known := replicated[evt.PubKey]
+		if !known {
+			ok = replicatesPubkey(evt.PubKey)
+			replicated[evt.PubKey] = ok
+		}
+		if ok {
+			outgoing = append(outgoing, evt)
+		}
+	}
+	enqueueReplication(outgoing...)
+}
+
+// enqueueReplication saves events in the outbox of every write relay and
+// wakes their workers.
+func enqueueReplication(evts ...nostr.Event) {
+	if len(evts) == 0 {
+		return
+	}
+
+	urls := writeRelays()
+	now := time.Now().Unix()
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, evt := range evts {
+		val, err := json.Marshal(outboxEntry{Event: evt, Queued: now})
+		if err != nil {
+			log.Printf("[ERROR] queueing event %s: %s", evt.ID, err)
+			continue
+		}
+		for _, url := range urls {
+			if err := wb.Set(outboxKey(url, now, evt.ID), val); err != nil {
+				log.Printf("[ERROR] queueing event %s for %s: %s", evt.ID, url, err)
+			}
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		log.Printf("[ERROR] saving outbox: %s", err)
+		return
+	}
+
+	for _, url := range urls {
+		metrics.ReplayRoutineQueueLength.WithLabelValues(url).Add(float64(len(evts)))
+	}
+	wakeOutboxWorkers()
+}
+
+func wakeOutboxWorkers() {
+	outboxMu.Lock()
+	defer outboxMu.Unlock()
+	for _, worker := range outboxWorkers {
+		select {
+		case worker.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// startOutbox starts the workers of the write relays. Events left in the
+// outbox by the last run are sent first.
+func startOutbox() {
+	outboxCtx, outboxCancel = context.WithCancel(context.Background())
+	syncOutboxWorkers()
+}
+
+// syncOutboxWorkers runs a worker for every write relay and drops the
+// outbox of relays that are no longer written to.
+func syncOutboxWorkers() {
+	if outboxCtx == nil {
+		return // not started yet
+	}
+	urls := writeRelays()
+
+	outboxMu.Lock()
+	defer outboxMu.Unlock()
+
+	for url, worker := range outboxWorkers {
+		if !slices.Contains(urls, url) {
+			worker.cancel()
+			delete(outboxWorkers, url)
+			metrics.ReplayRoutineQueueLength.DeleteLabelValues(url)
+		}
+	}
+	if err := pruneOutbox(urls); err != nil {
+		log.Printf("[ERROR] pruning outbox: %s", err)
+	}
+
+	for _, url := range urls {
+		if worker, ok := outboxWorkers[url]; ok {
+			// a relay that came back should not wait for the next poll
+			select {
+			case worker.wake <- struct{}{}:
+			default:
+			}
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(outboxCtx)
+		worker := &outboxWorker{
+			url:     url,
+			wake:    make(chan struct{}, 1),
+			notices: make(chan string, outboxNoticeBufferSize),
+			cancel:  cancel,
+		}
+		outboxWorkers[url] = worker
+
+		pending, err := countOutbox(url)
+		if err != nil {
+			log.Printf("[ERROR] counting outbox of %s: %s", url, err)
+		}
+		metrics.ReplayRoutineQueueLength.WithLabelValues(url).Set(float64(pending))
+		if pending > 0 {
+			log.Printf("[INFO] %d events waiting for %s", pending, url)
+		}
+
+		outboxDone.Add(1)
+		go worker.run(ctx)
+	}
+}
+
+// stopOutbox stops the workers after their current event. The outbox keeps
+// what is left for the next start.
+func stopOutbox() {
+	outboxCancel()
+	outboxDone.Wait()
+}
+
+func countOutbox(url string) (int, error) {
+	count := 0
+	err := db.View(func(txn *badger.Txn) error {
+		prefix := outboxRelayPrefix(url)
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// outboxKeyRelay returns the relay url of an outbox key.
+func outboxKeyRelay(key []byte) string {
+	url, _, _ := bytes.Cut(key[1:], []byte{0})
+	return string(url)
+}
+
+// deleteFromOutbox removes the entries that drop says so about, and returns
+// how many it removed per relay.
+func deleteFromOutbox(prefetchValues bool, drop func(key []byte, item *badger.Item) bool) (map[string]int, error) {
+	dropped := make(map[string]int)
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+
+	err := db.View(func(txn *badger.Txn) error {
+		prefix := []byte{registryOutboxPrefix}
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: prefetchValues, Prefix: prefix})
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().KeyCopy(nil)
+			if !drop(key, it.Item()) {
+				continue
+			}
+			if err := wb.Delete(key); err != nil {
+				return err
+			}
+			dropped[outboxKeyRelay(key)]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dropped, wb.Flush()
+}
+
+// pruneOutbox drops the entries of every relay but the ones in keep.
+func pruneOutbox(keep []string) error {
+	dropped, err := deleteFromOutbox(false, func(key []byte, _ *badger.Item) bool {
+		return !slices.Contains(keep, outboxKeyRelay(key))
+	})
+	for url, n := range dropped {
+		log.Printf("[INFO] dropped %d waiting events of %s, it is no longer a write relay", n, url)
+	}
+	return err
+}
+
+// dropFromOutbox removes the waiting events of a pubkey, for feeds that
+// were switched to local only or deleted.
+func dropFromOutbox(pubkeyHex string) error {
+	dropped, err := deleteFromOutbox(true, func(_ []byte, item *badger.Item) bool {
+		var entry outboxEntry
+		err := item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &entry)
+		})
+		return err == nil && entry.Event.PubKey == pubkeyHex
+	})
+	for url, n := range dropped {
+		metrics.ReplayRoutineQueueLength.WithLabelValues(url).Sub(float64(n))
+	}
+	return err
+}
+
+// SetFeedLocalOnly switches a feed between local only and replicated. A
+// feed that becomes replicated sends the events stored so far, a feed that
+// becomes local only drops the ones still waiting.
+func SetFeedLocalOnly(pubkeyHex string, localOnly bool) error {
+	wasLocalOnly := false
+	if err := UpdateEntity(pubkeyHex, func(e *models.Entity) {
+		wasLocalOnly = e.LocalOnly
+		e.LocalOnly = localOnly
+	}); err != nil {
+		return err
+	}
+
+	if localOnly {
+		return dropFromOutbox(pubkeyHex)
+	}
+	if !wasLocalOnly || !s.ReplicateEvents {
+		return nil
+	}
+
+	events, err := getLocalEvents(nostr.Filter{
+		Authors: []string{pubkeyHex},
+		Kinds:   []int{nostr.KindProfileMetadata, nostr.KindRelayListMetadata, nostr.KindTextNote, KIND_LONG_FORM},
+	})
+	if err != nil {
+		return err
+	}
+	outgoing := make([]nostr.Event, 0, len(events))
+	replaceables := make(map[int]bool)
+	for _, evt := range events {
+		// newest first, older versions of a replaceable event are stale
+		if evt.Kind == nostr.KindProfileMetadata || evt.Kind == nostr.KindRelayListMetadata {
+			if replaceables[evt.Kind] {
+				continue
+			}
+			replaceables[evt.Kind] = true
+		}
+		outgoing = append(outgoing, *evt)
+	}
+	enqueueReplication(outgoing...)
+	log.Printf("[DEBUG] %d stored events of %s queued for replication", len(outgoing), pubkeyHex)
+	return nil
+}
+
+func (w *outboxWorker) run(ctx context.Context) {
+	defer outboxDone.Done()
+	defer func() {
+		if w.relay != nil {
+			w.relay.Close()
+		}
+	}()
+
+	for {
+		timer := time.NewTimer(w.drain(ctx))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-w.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// drain sends the due events and returns how long to wait for the next.
+func (w *outboxWorker) drain(ctx context.Context) time.Duration {
+	if wait := time.Until(w.retryAt); wait > 0 {
+		return wait
+	}
+	if !seedRelayAlive(w.url) {
+		return outboxIdlePoll // the probes wake the worker once it is back
+	}
+
+	sent, failed := 0, 0
+	defer func() {
+		if sent+failed > 0 {
+			log.Printf("[DEBUG] replicated %d events to %s, %d failed", sent, w.url, failed)
+		}
+	}()
+
+	for ctx.Err() == nil {
+		keys, entries, next, err := w.dueEntries()
+		if err != nil {
+			log.Printf("[ERROR] reading outbox of %s: %s", w.url, err)
+			return outboxIdlePoll
+		}
+		if len(entries) == 0 {
+			if next == 0 {
+				return outboxIdlePoll
+			}
+			return min(max(time.Until(time.Unix(next, 0)), time.Second), outboxIdlePoll)
+		}
+
+		if err := w.connect(ctx); err != nil {
+			w.backoff = min(max(2*w.backoff, outboxRetryBase), outboxMaxRelayBackoff)
+			w.retryAt = time.Now().Add(w.backoff)
+			log.Printf("[WARN] seed relay %s unreachable, retrying in %s: %s", w.url, w.backoff, err)
+			return w.backoff
+		}
+		w.backoff = 0
+
+		for i := range entries {
+			if ctx.Err() != nil {
+				break
+			}
+			if w.publish(ctx, keys[i], entries[i]) {
+				sent++
+			} else {
+				failed++
+			}
+			if !w.relay.IsConnected() {
+				break
+			}
+		}
+	}
+	return 0
+}
+
+// dueEntries returns the next batch of events that are due, or the time of
+// the first event that is not.
+func (w *outboxWorker) dueEntries() (keys [][]byte, entries []outboxEntry, next int64, err error) {
+	now := time.Now().Unix()
+	err = db.View(func(txn *badger.Txn) error {
+		prefix := outboxRelayPrefix(w.url)
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: true,
+			PrefetchSize:   outboxBatchSize,
+			Prefix:         prefix,
+		})
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix) && len(entries) < outboxBatchSize; it.Next() {
+			key := it.Item().KeyCopy(nil)
+			if at := int64(binary.BigEndian.Uint64(key[len(prefix):])); at > now {
+				next = at
+				break
+			}
+
+			var entry outboxEntry
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &entry)
+			}); err != nil {
+				return err
+			}
+			keys = append(keys, key)
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return keys, entries, next, err
+}
+
+func (w *outboxWorker) connect(ctx context.Context) error {
+	if w.relay != nil && w.relay.IsConnected() {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, outboxConnectTimeout)
+	defer cancel()
+	relay, err := nostr.RelayConnect(ctx, w.url, nostr.WithNoticeHandler(func(notice string) {
+		log.Printf("[DEBUG] notice from %s: %s", w.url, notice)
+		select {
+		case w.notices <- notice:
+		default:
+		}
+	}))
+	if err != nil {
+		return err
+	}
+	w.relay = relay
+	return nil
+}
+
+// publish sends one event and settles its outbox entry: accepted and
+// duplicate events leave the outbox, rejected ones are dropped, anything
+// else is tried again later. It reports whether the relay has the event.
+func (w *outboxWorker) publish(ctx context.Context, key []byte, entry outboxEntry) bool {
+	if entry.Queued > 0 && time.Since(time.Unix(entry.Queued, 0)) > outboxMaxAge {
+		metrics.ReplayErrorEvents.WithLabelValues(w.url).Inc()
+		log.Printf("[WARN] giving up on event %s for %s, it is waiting since %s", entry.Event.ID, w.url, time.Unix(entry.Queued, 0).Format(time.DateTime))
+		w.settle(key, nil)
+		return false
+	}
+
+	for len(w.notices) > 0 {
+		<-w.notices
+	}
+
+	publishCtx, cancel := context.WithTimeout(ctx, outboxPublishTimeout)
+	err := w.relay.Publish(publishCtx, entry.Event)
+	cancel()
+	if ctx.Err() != nil {
+		// shutting down, the attempt does not count
+		return false
+	}
+
+	// relays that do not speak NIP-20 answer with a notice instead of OK
+	if err != nil && !strings.HasPrefix(err.Error(), "msg: ") {
+		select {
+		case notice := <-w.notices:
+			err = fmt.Errorf("notice: %s", notice)
+		default:
+		}
+	}
+
+	reason := ""
+	if err != nil {
+		reason = strings.TrimPrefix(err.Error(), "msg: ")
+	}
+
+	switch {
+	case err == nil || strings.HasPrefix(reason, "duplicate:"):
+		metrics.ReplayEvents.WithLabelValues(w.url).Inc()
+		metrics.NotesBlasted.Inc()
+		w.settle(key, nil)
+		return true
+	case strings.HasPrefix(err.Error(), "msg: ") && slices.ContainsFunc(permanentRejections, func(prefix string) bool {
+		return strings.HasPrefix(reason, prefix)
+	}):
+		metrics.ReplayErrorEvents.WithLabelValues(w.url).Inc()
+		log.Printf("[WARN] %s rejected event %s: %s", w.url, entry.Event.ID, reason)
+		w.settle(key, nil)
+		return false
+	}
+
+	metrics.ReplayErrorEvents.WithLabelValues(w.url).Inc()
+	entry.Attempts++
+	entry.LastError = reason
+	if entry.Attempts >= outboxMaxAttempts {
+		log.Printf("[WARN] giving up on event %s for %s after %d attempts: %s", entry.Event.ID, w.url, entry.Attempts, reason)
+		w.settle(key, nil)
+		return false
+	}
+	w.settle(key, &entry)
+	return false
+}
+
+// settle removes an entry from the outbox, or moves it to the time of its
+// next attempt when retry is set. Entries dropped meanwhile stay dropped.
+func (w *outboxWorker) settle(key []byte, retry *outboxEntry) {
+	gone := false
+	err := updateTxn(func(txn *badger.Txn) error {
+		gone = false
+		if _, err := txn.Get(key); errors.Is(err, badger.ErrKeyNotFound) {
+			gone = true
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+		if retry == nil {
+			return nil
+		}
+
+		val, err := json.Marshal(retry)
+		if err != nil {
+			return err
+		}
+		delay := min(outboxRetryBase<<(retry.Attempts-1), outboxMaxRetry)
+		return txn.Set(outboxKey(w.url, time.Now().Add(delay).Unix(), retry.Event.ID), val)
+	})
+	if err != nil {
+		log.Printf("[ERROR] updating outbox of %s: %s", w.url, err)
+		return
+	}
+
+	if retry == nil && !gone {
+		metrics.ReplayRoutineQueueLength.WithLabelValues(w.url).Dec()
+	}
+}
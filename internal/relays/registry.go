@@ -0,0 +1,618 @@
+package relays
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"rssnotes/internal/models"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// The feed registry lives in the same badger store as the events, under
+// prefixes that the eventstore does not use (it owns 0-8 and 255).
+const (
+	registryFeedPrefix    byte = 128 // pubkey -> json Entity
+	registryURLPrefix     byte = 129 // feed url -> pubkey
+	registryVersionPrefix byte = 130 // schema version of the registry itself
+	// 131 is the seen items set, see seen.go
+	// 132 is the handled direct messages set, see dm.go
+	// 133 is the nip05 name index, see nip05.go
+	// 134 is the outbox of events to replicate, see outbox.go
+	// 135 is the seed relay list, see seedrelays.go
+)
+
+var ErrEntityNotFound = errors.New("feed entity not found")
+
+func registryFeedKey(pubkeyHex string) []byte {
+	return append([]byte{registryFeedPrefix}, []byte(pubkeyHex)...)
+}
+
+func registryURLKey(feedUrl string) []byte {
+	return append([]byte{registryURLPrefix}, []byte(feedUrl)...)
+}
+
+func registryVersionKey() []byte {
+	return []byte{registryVersionPrefix}
+}
+
+func getEntityTxn(txn *badger.Txn, pubkeyHex string) (models.Entity, error) {
+	var entity models.Entity
+
+	item, err := txn.Get(registryFeedKey(pubkeyHex))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return models.Entity{}, ErrEntityNotFound
+	} else if err != nil {
+		return models.Entity{}, err
+	}
+
+	if err := item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &entity)
+	}); err != nil {
+		return models.Entity{}, err
+	}
+
+	return entity, nil
+}
+
+func getPubkeyForURLTxn(txn *badger.Txn, feedUrl string) (string, error) {
+	item, err := txn.Get(registryURLKey(feedUrl))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return "", ErrEntityNotFound
+	} else if err != nil {
+		return "", err
+	}
+
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		return "", err
+	}
+	return string(val), nil
+}
+
+func putEntityTxn(txn *badger.Txn, entity models.Entity) error {
+	if entity.PubKey == "" || entity.URL == "" {
+		return fmt.Errorf("entity needs a pubkey and a url")
+	}
+
+	// drop the url index of the previous version if the url changed
+	previous, err := getEntityTxn(txn, entity.PubKey)
+	if err == nil && previous.URL != entity.URL {
+		if err := txn.Delete(registryURLKey(previous.URL)); err != nil {
+			return err
+		}
+	}
+	if err := putNIP05NameTxn(txn, previous, entity); err != nil {
+		return err
+	}
+
+	if err := sealPrivateKey(&entity); err != nil {
+		return err
+	}
+
+	entity.SchemaVersion = models.EntitySchemaVersion
+	entityBytes, err := json.Marshal(entity)
+	if err != nil {
+		return err
+	}
+
+	if err := txn.Set(registryFeedKey(entity.PubKey), entityBytes); err != nil {
+		return err
+	}
+	return txn.Set(registryURLKey(entity.URL), []byte(entity.PubKey))
+}
+
+func deleteEntityTxn(txn *badger.Txn, entity models.Entity) error {
+	if err := txn.Delete(registryFeedKey(entity.PubKey)); err != nil {
+		return err
+	}
+	if err := txn.Delete(registrySeenKey(entity.PubKey)); err != nil {
+		return err
+	}
+	if entity.NIP05Name != "" {
+		if owner, err := getNIP05OwnerTxn(txn, entity.NIP05Name); err != nil {
+			return err
+		} else if owner == entity.PubKey {
+			if err := txn.Delete(registryNIP05Key(entity.NIP05Name)); err != nil {
+				return err
+			}
+		}
+	}
+	return txn.Delete(registryURLKey(entity.URL))
+}
+
+// TRUE if a feed with this pubkey or url is registered
+func FeedExists(pubkeyHex, feedUrl string) (bool, error) {
+	if feedUrl == "" {
+		log.Printf("[ERROR] feedURL is empty")
+		return false, fmt.Errorf("feedURL is empty")
+	}
+
+	exists := false
+	err := db.View(func(txn *badger.Txn) error {
+		if _, err := getEntityTxn(txn, pubkeyHex); err == nil {
+			exists = true
+			return nil
+		} else if !errors.Is(err, ErrEntityNotFound) {
+			return err
+		}
+
+		if _, err := getPubkeyForURLTxn(txn, feedUrl); err == nil {
+			exists = true
+			return nil
+		} else if !errors.Is(err, ErrEntityNotFound) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[ERROR] FeedExists %s", err)
+		return false, err
+	}
+
+	if exists {
+		log.Printf("[DEBUG] feedUrl %s already exists", feedUrl)
+	} else {
+		log.Printf("[DEBUG] feed %s does not exist", feedUrl)
+	}
+	return exists, nil
+}
+
+func AddEntities(entitiesToAdd []models.Entity) error {
+	var saveErr error
+	saved := make([]models.Entity, 0, len(entitiesToAdd))
+
+	for _, ent := range entitiesToAdd {
+		if ent.PubKey == "" || ent.URL == "" {
+			log.Printf("[ERROR] entity %q needs a pubkey and a url", ent.URL)
+			continue
+		}
+
+		// keep a given name when it is free, like assignNIP05Name
+		base := ent.NIP05Name
+		if base == "" {
+			base = nip05BaseName(ent.URL)
+		}
+		err := updateTxn(func(txn *badger.Txn) error {
+			var err error
+			if ent.NIP05Name, err = freeNIP05NameTxn(txn, base, ent.PubKey); err != nil {
+				return err
+			}
+			return putEntityTxn(txn, ent)
+		})
+		if err != nil {
+			log.Printf("[ERROR] saving entity %s: %s", ent.URL, err)
+			saveErr = errors.Join(saveErr, err)
+			continue
+		}
+		saved = append(saved, ent)
+	}
+
+	for _, ent := range saved {
+		if ent.PrivateKey != "" {
+			if err := updateMetadataNIP05(ent.PubKey, ent.PrivateKey, NIP05Identifier(ent.NIP05Name)); err != nil {
+				log.Printf("[ERROR] updating nip05 in profile of %s: %s", ent.URL, err)
+			}
+			if err := publishRelayList(ent.PubKey, ent.PrivateKey); err != nil {
+				log.Printf("[ERROR] relay list of %s: %s", ent.URL, err)
+			}
+		}
+		scheduleFeed(ent)
+	}
+
+	log.Printf("[DEBUG] %d entities saved", len(saved))
+	return saveErr
+}
+
+// Transactions that lose a conflict with a concurrent one are run again a
+// few times before the conflict is returned.
+const (
+	conflictRetries    = 5
+	conflictRetryDelay = 10 * time.Millisecond
+)
+
+// updateTxn runs fn in a read-write transaction, retrying it on conflicts.
+// fn must not keep state from an earlier attempt.
+func updateTxn(fn func(txn *badger.Txn) error) error {
+	err := db.Update(fn)
+	for attempt := 1; errors.Is(err, badger.ErrConflict) && attempt < conflictRetries; attempt++ {
+		time.Sleep(time.Duration(attempt) * conflictRetryDelay)
+		err = db.Update(fn)
+	}
+	return err
+}
+
+// UpdateEntity applies update to the stored entity of pubkeyHex in a single transaction.
+func UpdateEntity(pubkeyHex string, update func(*models.Entity)) error {
+	return updateTxn(func(txn *badger.Txn) error {
+		entity, err := getEntityTxn(txn, pubkeyHex)
+		if err != nil {
+			return err
+		}
+		update(&entity)
+		entity.PubKey = pubkeyHex
+		return putEntityTxn(txn, entity)
+	})
+}
+
+// update entity time properties and http validators, and fill in a missing
+// title and site url
+func updateEntityTimes(updatedEntity models.Entity) error {
+	err := UpdateEntity(updatedEntity.PubKey, func(entity *models.Entity) {
+		if entity.Title == "" {
+			entity.Title = updatedEntity.Title
+		}
+		if entity.SiteURL == "" {
+			entity.SiteURL = updatedEntity.SiteURL
+		}
+		entity.LastPostTime = updatedEntity.LastPostTime
+		entity.LastCheckedTime = updatedEntity.LastCheckedTime
+		entity.AvgPostTime = updatedEntity.AvgPostTime
+		entity.ETag = updatedEntity.ETag
+		entity.LastModified = updatedEntity.LastModified
+		markFeedHealthy(entity)
+	})
+	if err != nil {
+		log.Printf("[ERROR] updating entity %s: %s", updatedEntity.PubKey, err)
+		return err
+	}
+
+	log.Printf("[DEBUG] entity %s last post time %d", updatedEntity.PubKey, updatedEntity.LastPostTime)
+	return nil
+}
+
+// DeleteEntity removes a feed and its events. Unless localOnly or the feed
+// is not replicated, it also asks other relays to delete its events and
+// gets a retired profile.
+func DeleteEntity(pubKeyORfeedUrl string, localOnly bool) error {
+	var rsslayEntity models.Entity
+
+	// wait for a check of the feed that is publishing, see checkFeed
+	feedDeleteMu.Lock()
+	err := db.Update(func(txn *badger.Txn) error {
+		pubkeyHex := pubKeyORfeedUrl
+		if _, err := getEntityTxn(txn, pubkeyHex); errors.Is(err, ErrEntityNotFound) {
+			if pubkeyHex, err = getPubkeyForURLTxn(txn, pubKeyORfeedUrl); err != nil {
+				return err
+			}
+		}
+
+		entity, err := getEntityTxn(txn, pubkeyHex)
+		if err != nil {
+			return err
+		}
+		rsslayEntity = entity
+
+		return deleteEntityTxn(txn, entity)
+	})
+	feedDeleteMu.Unlock()
+	if errors.Is(err, ErrEntityNotFound) {
+		log.Printf("[DEBUG] entity %s not found", pubKeyORfeedUrl)
+		return nil
+	} else if err != nil {
+		log.Printf("[ERROR] deleting entity %s", err)
+		return err
+	}
+	unscheduleFeed(rsslayEntity.PubKey)
+
+	//delete related notes
+	feedKinds := []int{nostr.KindTextNote, nostr.KindProfileMetadata, KIND_LONG_FORM, nostr.KindRelayListMetadata}
+	privateKeys := make(map[string]string)
+	if !replicates(rsslayEntity) {
+		localOnly = true
+	}
+	// events still waiting would reach other relays after the deletion
+	// requests, so they go first
+	if err := dropFromOutbox(rsslayEntity.PubKey); err != nil {
+		log.Printf("[ERROR] dropping %s from the outbox: %s", rsslayEntity.URL, err)
+	}
+	if !localOnly {
+		if privateKey, err := openPrivateKey(rsslayEntity); err != nil {
+			log.Printf("[ERROR] could not decrypt private key of %s, deleting its events only here: %s", rsslayEntity.URL, err)
+		} else {
+			privateKeys[rsslayEntity.PubKey] = privateKey
+		}
+	}
+	retire := len(privateKeys) > 0 && s.RetireFeedProfile
+	if retire {
+		feedKinds = []int{nostr.KindTextNote, KIND_LONG_FORM, nostr.KindRelayListMetadata}
+	}
+
+	if err := retractEvents(nostr.Filter{
+		Authors: []string{rsslayEntity.PubKey},
+		Kinds:   feedKinds}, privateKeys, "feed deleted"); err != nil {
+		log.Printf("[ERROR] deleting feed events: %s", err)
+	}
+
+	if retire {
+		if evt, err := retireFeedProfile(rsslayEntity.PubKey, privateKeys[rsslayEntity.PubKey]); err != nil {
+			log.Printf("[ERROR] retiring profile of %s: %s", rsslayEntity.URL, err)
+		} else {
+			enqueueReplication(evt)
+		}
+	}
+
+	// the feed is gone already, a qr code left behind is only logged
+	if npub, err := nip19.EncodePublicKey(rsslayEntity.PubKey); err != nil {
+		log.Printf("[ERROR] %s", err)
+	} else if err := os.Remove(fmt.Sprintf("%s/%s.png", s.QRCodePath, npub)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Print("[ERROR] qrcode delete: ", err)
+	}
+
+	log.Printf("[DEBUG] entity %s deleted", rsslayEntity.URL)
+	return nil
+}
+
+func GetSavedEntries() ([]models.GUIEntry, error) {
+	entities, err := GetSavedEntities()
+	if err != nil {
+		return []models.GUIEntry{}, err
+	}
+
+	localEntries := make([]models.GUIEntry, 0, len(entities))
+	for _, entity := range entities {
+		npub, _ := nip19.EncodePublicKey(entity.PubKey)
+		localEntries = append(localEntries, models.GUIEntry{
+			BookmarkEntity: models.Entity{
+				PubKey:              entity.PubKey,
+				URL:                 entity.URL,
+				ImageURL:            entity.ImageURL,
+				LastPostTime:        entity.LastPostTime,
+				LastCheckedTime:     entity.LastCheckedTime,
+				ConsecutiveFailures: entity.ConsecutiveFailures,
+				LastErrorClass:      entity.LastErrorClass,
+				LastError:           entity.LastError,
+				LastSuccessTime:     entity.LastSuccessTime,
+				NoteTemplate:        entity.NoteTemplate,
+				OutputMode:          entity.OutputMode,
+				HashtagAllow:        entity.HashtagAllow,
+				HashtagDeny:         entity.HashtagDeny,
+				AppendHashtags:      entity.AppendHashtags,
+				Paused:              entity.Paused,
+				NIP05Name:           entity.NIP05Name},
+			NPubKey:  npub,
+			NProfile: NProfile(entity.PubKey),
+		})
+	}
+
+	if len(localEntries) == 0 {
+		log.Printf("[DEBUG] no saved feedURL entries")
+	}
+	return localEntries, nil
+}
+
+func GetSavedEntity(pubkeyHex string) (models.Entity, error) {
+	var entity models.Entity
+
+	err := db.View(func(txn *badger.Txn) error {
+		var err error
+		entity, err = getEntityTxn(txn, pubkeyHex)
+		return err
+	})
+	if errors.Is(err, ErrEntityNotFound) {
+		log.Printf("[DEBUG] feed entity not found")
+		return models.Entity{}, nil
+	} else if err != nil {
+		log.Printf("[ERROR] GetSavedEntity %s", err)
+		return models.Entity{}, err
+	}
+
+	return entity, nil
+}
+
+func GetSavedEntityByURL(feedUrl string) (models.Entity, error) {
+	var entity models.Entity
+
+	err := db.View(func(txn *badger.Txn) error {
+		pubkeyHex, err := getPubkeyForURLTxn(txn, feedUrl)
+		if err != nil {
+			return err
+		}
+		entity, err = getEntityTxn(txn, pubkeyHex)
+		return err
+	})
+	if errors.Is(err, ErrEntityNotFound) {
+		log.Printf("[DEBUG] feed entity not found")
+		return models.Entity{}, nil
+	} else if err != nil {
+		log.Printf("[ERROR] GetSavedEntityByURL %s", err)
+		return models.Entity{}, err
+	}
+
+	return entity, nil
+}
+
+func GetSavedEntities() ([]models.Entity, error) {
+	entities := make([]models.Entity, 0)
+
+	err := db.View(func(txn *badger.Txn) error {
+		prefix := []byte{registryFeedPrefix}
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: true,
+			PrefetchSize:   100,
+			Prefix:         prefix,
+		})
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var entity models.Entity
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &entity)
+			}); err != nil {
+				log.Printf("[ERROR] %s", err)
+				continue
+			}
+			entities = append(entities, entity)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[ERROR] GetSavedEntities %s", err)
+		return []models.Entity{}, err
+	}
+
+	if len(entities) == 0 {
+		log.Printf("[DEBUG] feed entity not found")
+	}
+	return entities, nil
+}
+
+func getRegistryVersion() (int, error) {
+	version := 0
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(registryVersionKey())
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if len(val) > 0 {
+				version = int(val[0])
+			}
+			return nil
+		})
+	})
+	return version, err
+}
+
+func setRegistryVersion(version int) error {
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set(registryVersionKey(), []byte{byte(version)})
+	})
+}
+
+// migrateRegistry brings the feed registry up to models.EntitySchemaVersion,
+// one step at a time.
+func migrateRegistry() error {
+	version, err := getRegistryVersion()
+	if err != nil {
+		return err
+	}
+
+	if version < 1 {
+		if err := migrateBookmarkRegistry(); err != nil {
+			return err
+		}
+		if err := setRegistryVersion(1); err != nil {
+			return err
+		}
+	}
+
+	if version < 2 {
+		if err := migrateEncryptPrivateKeys(); err != nil {
+			return err
+		}
+		if err := setRegistryVersion(2); err != nil {
+			return err
+		}
+	}
+
+	if version < 3 {
+		if err := migrateNIP05Names(); err != nil {
+			return err
+		}
+		if err := setRegistryVersion(3); err != nil {
+			return err
+		}
+	}
+
+	if version < 4 {
+		// start without seed relays rather than not at all, the file is
+		// imported again on the next start
+		if err := migrateSeedRelays(); err != nil {
+			log.Printf("[ERROR] importing seed relays, fix %s and restart: %s", s.SeedRelaysPath, err)
+			return nil
+		}
+		if err := setRegistryVersion(4); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateBookmarkRegistry copies the feeds stored as json tags of the
+// legacy kind-10003 bookmark event into the registry. Broken entries are
+// left out. Nothing is published or scheduled here, InitRelay and the feed
+// scheduler do that for every feed once the relay is up.
+func migrateBookmarkRegistry() error {
+	bookMarkEvts, err := getLocalEvents(nostr.Filter{
+		Kinds:   []int{KIND_BOOKMARKS},
+		Authors: []string{s.RelayPubkey},
+	})
+	if err != nil {
+		return err
+	}
+
+	entities := make([]models.Entity, 0)
+	if len(bookMarkEvts) > 0 {
+		for _, tag := range bookMarkEvts[0].Tags.GetAll([]string{s.RsslayTagKey}) {
+			var entity models.Entity
+			if err := json.Unmarshal([]byte(tag.Value()), &entity); err != nil {
+				log.Printf("[ERROR] migrating bookmark tag: %s", err)
+				continue
+			}
+			entity.PubKey = strings.TrimSpace(entity.PubKey)
+			entities = append(entities, entity)
+		}
+	}
+
+	migrated := 0
+	err = db.Update(func(txn *badger.Txn) error {
+		migrated = 0
+		for _, entity := range entities {
+			if err := putEntityTxn(txn, entity); err != nil {
+				log.Printf("[ERROR] migrating bookmarked feed %q: %s", entity.URL, err)
+				continue
+			}
+			migrated++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// the bookmark events hold the feed private keys in plain text
+	if err := deleteLocalEvents(nostr.Filter{
+		Kinds:   []int{KIND_BOOKMARKS},
+		Authors: []string{s.RelayPubkey},
+	}); err != nil {
+		log.Printf("[ERROR] deleting migrated bookmark events: %s", err)
+	}
+
+	log.Printf("[INFO] migrated %d of %d feeds from bookmark event to the feed registry", migrated, len(entities))
+	return nil
+}
+
+// migrateEncryptPrivateKeys re-saves every entity that still holds a
+// plain text private key so it gets encrypted.
+func migrateEncryptPrivateKeys() error {
+	entities, err := GetSavedEntities()
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for _, entity := range entities {
+		if entity.PrivateKey == "" {
+			continue
+		}
+		if err := db.Update(func(txn *badger.Txn) error {
+			return putEntityTxn(txn, entity)
+		}); err != nil {
+			return err
+		}
+		count++
+	}
+
+	log.Printf("[INFO] encrypted the private keys of %d feeds", count)
+	return nil
+}
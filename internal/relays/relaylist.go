@@ -0,0 +1,122 @@
+package relays
+
+import (
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// PublicRelayURL is the websocket url clients reach this relay on.
+func PublicRelayURL() string {
+	return nostr.NormalizeURL(s.RelayURL + s.RelayBasepath)
+}
+
+// NProfile encodes a pubkey with this relay as hint.
+func NProfile(pubkeyHex string) string {
+	nprofile, err := nip19.EncodeProfile(pubkeyHex, []string{PublicRelayURL()})
+	if err != nil {
+		log.Printf("[ERROR] nprofile of %s: %s", pubkeyHex, err)
+		return ""
+	}
+	return nprofile
+}
+
+// DecodePubkey returns the hex pubkey of a hex key, npub or nprofile, or an
+// empty string for anything else.
+func DecodePubkey(key string) string {
+	key = strings.TrimPrefix(key, "nostr:")
+	if nostr.IsValidPublicKey(key) {
+		return key
+	}
+
+	prefix, value, err := nip19.Decode(key)
+	if err != nil {
+		return ""
+	}
+	switch prefix {
+	case "npub":
+		return value.(string)
+	case "nprofile":
+		return value.(nostr.ProfilePointer).PublicKey
+	}
+	return ""
+}
+
+// relayListURLs are the relays named in the NIP-65 lists: this relay and
+// the seed relays events are replicated to, or the ones picked in
+// RELAY_LIST_RELAYS when nothing is replicated.
+func relayListURLs() []string {
+	others := s.RelayListRelays
+	if replicated := writeRelays(); s.ReplicateEvents && len(replicated) > 0 {
+		others = replicated
+	}
+
+	urls := []string{PublicRelayURL()}
+	for _, url := range others {
+		if url = nostr.NormalizeURL(url); url != "" && !slices.Contains(urls, url) {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// publishRelayList stores and replicates a kind-10002 for a pubkey, unless the
+// stored one already names the same relays.
+func publishRelayList(pubkeyHex, privateKey string) error {
+	urls := relayListURLs()
+
+	previous, err := getLocalEvents(nostr.Filter{
+		Kinds:   []int{nostr.KindRelayListMetadata},
+		Authors: []string{pubkeyHex},
+	})
+	if err != nil {
+		return err
+	}
+	if len(previous) > 0 {
+		current := make([]string, 0, len(urls))
+		for _, tag := range previous[0].Tags.GetAll([]string{"r", ""}) {
+			current = append(current, tag.Value())
+		}
+		if slices.Equal(current, urls) {
+			return nil
+		}
+	}
+
+	evt := nostr.Event{
+		PubKey:    pubkeyHex,
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindRelayListMetadata,
+		Tags:      make(nostr.Tags, 0, len(urls)),
+	}
+	if len(previous) > 0 {
+		evt.CreatedAt = max(evt.CreatedAt, previous[0].CreatedAt+1)
+	}
+	for _, url := range urls {
+		evt.Tags = append(evt.Tags, nostr.Tag{"r", url})
+	}
+	if err := evt.Sign(privateKey); err != nil {
+		return err
+	}
+
+	deleteStoredEvents(previous)
+	storeLocalEvent(&evt)
+	replicateEvents(evt)
+	return nil
+}
+
+// syncRelayLists brings the relay lists of the relay pubkey and all feeds
+// in line with the configured relays and the write seed relays.
+func syncRelayLists() {
+	if err := publishRelayList(s.RelayPubkey, s.RelayPrivkey); err != nil {
+		log.Printf("[ERROR] relay list of the relay pubkey: %s", err)
+	}
+
+	for pubkey, privateKey := range feedPrivateKeys(false) {
+		if err := publishRelayList(pubkey, privateKey); err != nil {
+			log.Printf("[ERROR] relay list of %s: %s", pubkey, err)
+		}
+	}
+}
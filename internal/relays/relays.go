@@ -7,12 +7,12 @@ import (
 	"log"
 	"os"
 	"rssnotes/internal/config"
-	"rssnotes/internal/helpers"
+	"rssnotes/internal/yarr/yarrparser"
+	"time"
 
 	"github.com/fiatjaf/eventstore/badger"
 	"github.com/fiatjaf/khatru"
 	"github.com/fiatjaf/khatru/policies"
-	"github.com/mmcdole/gofeed"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip19"
 	"github.com/skip2/go-qrcode"
@@ -22,20 +22,15 @@ var (
 	db         = badger.BadgerBackend{}
 	rly        = khatru.NewRelay()
 	pool       *nostr.SimplePool
-	seedRelays []string
+	poolCancel context.CancelFunc
 	s          config.C
 )
 
 func InitRelay(cfg config.C) *khatru.Relay {
 	s = cfg
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
 	pool = nostr.NewSimplePool(ctx)
-
-	seedRelays = helpers.GetRelayListFromFile(cfg.SeedRelaysPath)
-	if len(seedRelays) == 0 {
-		log.Panic("[FATAL] 0 seed relays; need to set relays")
-		return nil
-	}
+	poolCancel = cancel
 
 	//returned on the NIP-11 endpoint
 	rly.Info.Name = cfg.RelayName
@@ -50,7 +45,6 @@ func InitRelay(cfg config.C) *khatru.Relay {
 		log.Panicf("[FATAL] db init: %s", err)
 		return nil
 	}
-	//defer db.Close()
 
 	rly.StoreEvent = append(rly.StoreEvent, db.SaveEvent)
 	rly.QueryEvents = append(rly.QueryEvents, db.QueryEvents)
@@ -66,9 +60,33 @@ func InitRelay(cfg config.C) *khatru.Relay {
 		policyFilterBookmark,
 	)
 
-	if err := CreateMetadataNote(cfg.RelayPubkey, cfg.RelayPrivkey, &gofeed.Feed{Title: cfg.RelayName, Description: cfg.RelayDescription}, cfg.DefaultProfilePicUrl); err != nil {
+	if err := initKeyEncryption(cfg); err != nil {
+		log.Panicf("[FATAL] %s", err)
+		return nil
+	}
+
+	if err := migrateRegistry(); err != nil {
+		log.Panicf("[FATAL] feed registry migration: %s", err)
+		return nil
+	}
+
+	if err := loadSeedRelays(); err != nil {
+		log.Panicf("[FATAL] loading seed relays: %s", err)
+		return nil
+	}
+	if len(GetSeedRelays()) == 0 {
+		log.Print("[WARN] 0 seed relays, add some on the home page")
+	}
+	startSeedRelayProbes(time.Duration(cfg.SeedRelayCheckMinutes) * time.Minute)
+	startOutbox()
+
+	if err := CreateMetadataNote(cfg.RelayPubkey, cfg.RelayPrivkey, &yarrparser.Feed{Title: cfg.RelayName, Description: cfg.RelayDescription}, cfg.DefaultProfilePicUrl); err != nil {
+		log.Print("[ERROR] ", err)
+	}
+	if err := updateMetadataNIP05(cfg.RelayPubkey, cfg.RelayPrivkey, NIP05Identifier(NIP05RelayName)); err != nil {
 		log.Print("[ERROR] ", err)
 	}
+	syncRelayLists()
 
 	npub, err := nip19.EncodePublicKey(cfg.RelayPubkey)
 	if err != nil {
@@ -76,10 +94,28 @@ func InitRelay(cfg config.C) *khatru.Relay {
 	}
 
 	if _, err := os.Stat(fmt.Sprintf("%s/%s.png", cfg.QRCodePath, npub)); errors.Is(err, os.ErrNotExist) {
-		if err := qrcode.WriteFile(fmt.Sprintf("nostr:%s", npub), qrcode.Low, 128, fmt.Sprintf("%s/%s.png", cfg.QRCodePath, npub)); err != nil {
+		if err := qrcode.WriteFile(fmt.Sprintf("nostr:%s", NProfile(cfg.RelayPubkey)), qrcode.Low, 128, fmt.Sprintf("%s/%s.png", cfg.QRCodePath, npub)); err != nil {
 			log.Print("[ERROR] creating relay QR code ", err)
 		}
 	}
 
 	return rly
 }
+
+// CloseRelay stops the seed relay probes and replication, disconnects from
+// the seed relays and closes the event store. Nothing may use the relay
+// afterwards.
+func CloseRelay() {
+	stopSeedRelayProbes()
+	stopOutbox()
+	poolCancel()
+	pool.Relays.Range(func(url string, relay *nostr.Relay) bool {
+		if err := relay.Close(); err != nil {
+			log.Printf("[DEBUG] closing relay %s: %s", url, err)
+		}
+		return true
+	})
+
+	db.Close()
+	log.Print("[INFO] event store closed")
+}
@@ -0,0 +1,301 @@
+package relays
+
+import (
+	"container/heap"
+	"errors"
+	"log"
+	"rssnotes/internal/helpers"
+	"rssnotes/internal/models"
+	"rssnotes/metrics"
+	"sync"
+	"time"
+)
+
+// scheduledFeed is a feed waiting in the queue until its due time.
+type scheduledFeed struct {
+	pubkey string
+	due    int64
+	force  bool // check even if the feed is not due by its own schedule
+	index  int
+}
+
+// feedQueue is a min-heap of feeds ordered by due time.
+type feedQueue []*scheduledFeed
+
+func (q feedQueue) Len() int           { return len(q) }
+func (q feedQueue) Less(i, j int) bool { return q[i].due < q[j].due }
+func (q feedQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *feedQueue) Push(x any) {
+	item := x.(*scheduledFeed)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *feedQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	item.index = -1
+	return item
+}
+
+// feedScheduler hands feeds to a pool of workers as they come due. Feeds
+// being checked are out of the queue and get rescheduled by their worker.
+type feedScheduler struct {
+	mu      sync.Mutex
+	queue   feedQueue
+	queued  map[string]*scheduledFeed
+	running map[string]bool
+
+	jobs chan scheduledFeed
+	wake chan struct{}
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+var scheduler *feedScheduler
+
+var ErrSchedulerStopped = errors.New("feed scheduler is not running")
+
+// StartFeedScheduler schedules all saved feeds and starts checking them
+// with the given number of workers.
+func StartFeedScheduler(workers int) {
+	scheduler = &feedScheduler{
+		queued:  make(map[string]*scheduledFeed),
+		running: make(map[string]bool),
+		jobs:    make(chan scheduledFeed),
+		wake:    make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+	}
+
+	SyncFeedSchedule()
+
+	for range max(workers, 1) {
+		scheduler.wg.Add(1)
+		go scheduler.work()
+	}
+	scheduler.wg.Add(1)
+	go scheduler.run()
+
+	log.Printf("[INFO] feed scheduler started with %d workers", max(workers, 1))
+}
+
+// StopFeedScheduler stops dispatching feeds and waits for the running
+// checks to finish.
+func StopFeedScheduler() {
+	if scheduler == nil {
+		return
+	}
+	close(scheduler.quit)
+	scheduler.wg.Wait()
+	log.Print("[INFO] feed scheduler stopped")
+}
+
+// SyncFeedSchedule brings the queue in line with the registry, adding feeds
+// that are missing and dropping deleted ones.
+func SyncFeedSchedule() {
+	if scheduler == nil {
+		return
+	}
+
+	entities, err := GetSavedEntities()
+	if err != nil {
+		log.Printf("[ERROR] could not sync feed schedule: %s", err)
+		return
+	}
+
+	saved := make(map[string]bool, len(entities))
+	for _, entity := range entities {
+		saved[entity.PubKey] = true
+		scheduler.schedule(entity)
+	}
+
+	scheduler.mu.Lock()
+	for pubkey := range scheduler.queued {
+		if !saved[pubkey] {
+			scheduler.removeLocked(pubkey)
+		}
+	}
+	scheduler.mu.Unlock()
+}
+
+// CheckFeedNow moves a feed to the front of the queue. A feed that is being
+// checked right now is left alone.
+func CheckFeedNow(pubkeyHex string) error {
+	entity, err := GetSavedEntity(pubkeyHex)
+	if err != nil {
+		return err
+	} else if entity.PubKey == "" {
+		return ErrEntityNotFound
+	}
+
+	if scheduler == nil {
+		return ErrSchedulerStopped
+	}
+	scheduler.scheduleAt(entity.PubKey, time.Now().Unix(), true)
+	return nil
+}
+
+// SetFeedPaused stops or resumes the checks of a feed.
+func SetFeedPaused(pubkeyHex string, paused bool) error {
+	if err := UpdateEntity(pubkeyHex, func(e *models.Entity) {
+		e.Paused = paused
+	}); err != nil {
+		return err
+	}
+
+	entity, err := GetSavedEntity(pubkeyHex)
+	if err != nil {
+		return err
+	}
+	scheduleFeed(entity)
+	return nil
+}
+
+// scheduleFeed queues a new or changed feed, if the scheduler is running.
+func scheduleFeed(entity models.Entity) {
+	if scheduler != nil {
+		scheduler.schedule(entity)
+	}
+}
+
+// unscheduleFeed drops a deleted feed from the queue.
+func unscheduleFeed(pubkeyHex string) {
+	if scheduler != nil {
+		scheduler.mu.Lock()
+		scheduler.removeLocked(pubkeyHex)
+		scheduler.mu.Unlock()
+	}
+}
+
+func (fs *feedScheduler) schedule(entity models.Entity) {
+	if entity.Paused {
+		fs.mu.Lock()
+		fs.removeLocked(entity.PubKey)
+		fs.mu.Unlock()
+		return
+	}
+	fs.scheduleAt(entity.PubKey, helpers.NextFeedUpdate(entity), false)
+}
+
+func (fs *feedScheduler) scheduleAt(pubkeyHex string, due int64, force bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.running[pubkeyHex] {
+		return
+	}
+
+	if item, ok := fs.queued[pubkeyHex]; ok {
+		if item.force && !force {
+			return // a requested check stays at the front
+		}
+		item.due = due
+		item.force = force
+		heap.Fix(&fs.queue, item.index)
+	} else {
+		item := &scheduledFeed{pubkey: pubkeyHex, due: due, force: force}
+		heap.Push(&fs.queue, item)
+		fs.queued[pubkeyHex] = item
+	}
+	metrics.SchedulerQueueDepth.Set(float64(fs.queue.Len()))
+
+	select {
+	case fs.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (fs *feedScheduler) removeLocked(pubkeyHex string) {
+	if item, ok := fs.queued[pubkeyHex]; ok {
+		heap.Remove(&fs.queue, item.index)
+		delete(fs.queued, pubkeyHex)
+		metrics.SchedulerQueueDepth.Set(float64(fs.queue.Len()))
+	}
+}
+
+// nextDue pops the first feed when it is due, or returns how long to wait.
+func (fs *feedScheduler) nextDue() (*scheduledFeed, time.Duration) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.queue.Len() == 0 {
+		return nil, time.Hour
+	}
+
+	wait := time.Until(time.Unix(fs.queue[0].due, 0))
+	if wait > 0 {
+		return nil, wait
+	}
+
+	item := heap.Pop(&fs.queue).(*scheduledFeed)
+	delete(fs.queued, item.pubkey)
+	fs.running[item.pubkey] = true
+	metrics.SchedulerQueueDepth.Set(float64(fs.queue.Len()))
+	return item, 0
+}
+
+func (fs *feedScheduler) run() {
+	defer fs.wg.Done()
+	defer close(fs.jobs)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		item, wait := fs.nextDue()
+		if item != nil {
+			select {
+			case fs.jobs <- *item:
+			case <-fs.quit:
+				return
+			}
+			continue
+		}
+
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-fs.wake:
+			timer.Stop()
+		case <-fs.quit:
+			return
+		}
+	}
+}
+
+func (fs *feedScheduler) work() {
+	defer fs.wg.Done()
+
+	for item := range fs.jobs {
+		metrics.SchedulerLagSeconds.Set(float64(max(time.Now().Unix()-item.due, 0)))
+
+		entity, err := GetSavedEntity(item.pubkey)
+		if err != nil {
+			log.Printf("[ERROR] scheduler could not load feed %s: %s", item.pubkey, err)
+		}
+
+		if entity.PubKey != "" && (item.force || helpers.TimetoUpdateFeed(entity)) {
+			checkFeed(entity)
+			entity, err = GetSavedEntity(item.pubkey)
+			if err != nil {
+				log.Printf("[ERROR] scheduler could not reload feed %s: %s", item.pubkey, err)
+			}
+		}
+
+		fs.mu.Lock()
+		delete(fs.running, item.pubkey)
+		fs.mu.Unlock()
+
+		// deleted feeds, including retired ones, are not rescheduled
+		if entity.PubKey != "" {
+			fs.schedule(entity)
+		}
+	}
+}
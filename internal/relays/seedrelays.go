@@ -0,0 +1,368 @@
+package relays
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"rssnotes/internal/helpers"
+	"rssnotes/internal/models"
+	"rssnotes/metrics"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// registrySeedRelayPrefix keys map a relay url to its json SeedRelay.
+const registrySeedRelayPrefix byte = 135
+
+const seedRelayProbeTimeout = 10 * time.Second
+
+var (
+	ErrSeedRelayNoRole   = errors.New("a seed relay needs the read or the write role")
+	ErrSeedRelayNotFound = errors.New("seed relay not found")
+)
+
+// seedRelays caches the registry, so that the hot paths do not read it.
+var (
+	seedRelaysMu sync.RWMutex
+	seedRelays   []models.SeedRelay
+
+	// seedRelaysChanged wakes the direct message listener, which then
+	// subscribes again on the current read relays.
+	seedRelaysChanged = make(chan struct{}, 1)
+
+	// probeRequests hands new seed relays to the probe loop, which checks
+	// them right away instead of at the next interval.
+	probeRequests = make(chan string, 16)
+
+	probeCancel context.CancelFunc
+	probeDone   sync.WaitGroup
+)
+
+func registrySeedRelayKey(url string) []byte {
+	return append([]byte{registrySeedRelayPrefix}, []byte(url)...)
+}
+
+// GetSeedRelays returns the seed relays ordered by url.
+func GetSeedRelays() []models.SeedRelay {
+	seedRelaysMu.RLock()
+	defer seedRelaysMu.RUnlock()
+	return append([]models.SeedRelay(nil), seedRelays...)
+}
+
+// readRelays are the urls of the live seed relays to read from.
+func readRelays() []string {
+	return seedRelayURLs(func(r models.SeedRelay) bool { return r.Read && !r.Dead() })
+}
+
+// writeRelays are the urls of the seed relays to replicate to, dead or not,
+// so that their outbox fills up until they are back.
+func writeRelays() []string {
+	return seedRelayURLs(func(r models.SeedRelay) bool { return r.Write })
+}
+
+// liveWriteRelays are the write relays that answered the last probes.
+func liveWriteRelays() []string {
+	return seedRelayURLs(func(r models.SeedRelay) bool { return r.Write && !r.Dead() })
+}
+
+func seedRelayURLs(include func(models.SeedRelay) bool) []string {
+	seedRelaysMu.RLock()
+	defer seedRelaysMu.RUnlock()
+
+	urls := make([]string, 0, len(seedRelays))
+	for _, relay := range seedRelays {
+		if include(relay) {
+			urls = append(urls, relay.URL)
+		}
+	}
+	return urls
+}
+
+func seedRelayAlive(url string) bool {
+	seedRelaysMu.RLock()
+	defer seedRelaysMu.RUnlock()
+	for _, relay := range seedRelays {
+		if relay.URL == url {
+			return !relay.Dead()
+		}
+	}
+	return false
+}
+
+// loadSeedRelays fills the cache from the registry.
+func loadSeedRelays() error {
+	loaded := make([]models.SeedRelay, 0)
+	err := db.View(func(txn *badger.Txn) error {
+		prefix := []byte{registrySeedRelayPrefix}
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: true, Prefix: prefix})
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var relay models.SeedRelay
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &relay)
+			}); err != nil {
+				log.Printf("[ERROR] %s", err)
+				continue
+			}
+			loaded = append(loaded, relay)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	seedRelaysMu.Lock()
+	seedRelays = loaded
+	seedRelaysMu.Unlock()
+	return nil
+}
+
+func putSeedRelayTxn(txn *badger.Txn, relay models.SeedRelay) error {
+	val, err := json.Marshal(relay)
+	if err != nil {
+		return err
+	}
+	return txn.Set(registrySeedRelayKey(relay.URL), val)
+}
+
+func getSeedRelayTxn(txn *badger.Txn, url string) (models.SeedRelay, error) {
+	var relay models.SeedRelay
+	item, err := txn.Get(registrySeedRelayKey(url))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return relay, ErrSeedRelayNotFound
+	} else if err != nil {
+		return relay, err
+	}
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &relay)
+	})
+	return relay, err
+}
+
+// SaveSeedRelay adds a seed relay or changes the roles of one.
+func SaveSeedRelay(rawUrl string, read, write bool) (models.SeedRelay, error) {
+	url, err := helpers.NormalizeRelayURL(rawUrl)
+	if err != nil {
+		return models.SeedRelay{}, err
+	}
+	if !read && !write {
+		return models.SeedRelay{}, ErrSeedRelayNoRole
+	}
+
+	var relay models.SeedRelay
+	err = db.Update(func(txn *badger.Txn) error {
+		var err error
+		relay, err = getSeedRelayTxn(txn, url)
+		if errors.Is(err, ErrSeedRelayNotFound) {
+			relay = models.SeedRelay{URL: url, AddedTime: time.Now().Unix()}
+		} else if err != nil {
+			return err
+		}
+		relay.Read = read
+		relay.Write = write
+		return putSeedRelayTxn(txn, relay)
+	})
+	if err != nil {
+		return models.SeedRelay{}, err
+	}
+
+	log.Printf("[INFO] seed relay %s saved, read %t write %t", url, read, write)
+	seedRelaysUpdated()
+	if relay.LastCheckedTime == 0 {
+		select {
+		case probeRequests <- url:
+		default: // probed with the others at the next interval
+		}
+	}
+	return relay, nil
+}
+
+// DeleteSeedRelay removes a seed relay along with its outbox.
+func DeleteSeedRelay(rawUrl string) error {
+	url, err := helpers.NormalizeRelayURL(rawUrl)
+	if err != nil {
+		return err
+	}
+
+	err = db.Update(func(txn *badger.Txn) error {
+		if _, err := getSeedRelayTxn(txn, url); err != nil {
+			return err
+		}
+		return txn.Delete(registrySeedRelayKey(url))
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] seed relay %s deleted", url)
+	metrics.SeedRelayUp.DeleteLabelValues(url)
+	metrics.SeedRelayLatency.DeleteLabelValues(url)
+	seedRelaysUpdated()
+	return nil
+}
+
+// seedRelaysUpdated brings the cache, the outbox workers, the relay lists
+// and the direct message subscription in line with the registry.
+func seedRelaysUpdated() {
+	previousWriteRelays := writeRelays()
+	if err := loadSeedRelays(); err != nil {
+		log.Printf("[ERROR] loading seed relays: %s", err)
+		return
+	}
+	syncOutboxWorkers()
+	if !slices.Equal(previousWriteRelays, writeRelays()) {
+		syncRelayLists()
+	}
+	select {
+	case seedRelaysChanged <- struct{}{}:
+	default:
+	}
+}
+
+// startSeedRelayProbes checks every seed relay now and then every interval.
+func startSeedRelayProbes(interval time.Duration) {
+	var ctx context.Context
+	ctx, probeCancel = context.WithCancel(context.Background())
+
+	probeDone.Add(1)
+	go func() {
+		defer probeDone.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		probeSeedRelays(ctx)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case url := <-probeRequests:
+				probeSeedRelay(ctx, url)
+			case <-ticker.C:
+				probeSeedRelays(ctx)
+			}
+		}
+	}()
+}
+
+func stopSeedRelayProbes() {
+	probeCancel()
+	probeDone.Wait()
+}
+
+func probeSeedRelays(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, relay := range GetSeedRelays() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			probeSeedRelay(ctx, relay.URL)
+		}()
+	}
+	wg.Wait()
+}
+
+// probeSeedRelay connects to a relay and asks it for the relay profile, and
+// saves how long that took or why it failed.
+func probeSeedRelay(ctx context.Context, url string) {
+	probeCtx, cancel := context.WithTimeout(ctx, seedRelayProbeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	relay, probeErr := nostr.RelayConnect(probeCtx, url)
+	if probeErr == nil {
+		_, probeErr = relay.QuerySync(probeCtx, nostr.Filter{
+			Kinds:   []int{nostr.KindProfileMetadata},
+			Authors: []string{s.RelayPubkey},
+			Limit:   1,
+		})
+		relay.Close()
+	}
+	latency := time.Since(start)
+	if ctx.Err() != nil {
+		return // shutting down, the probe says nothing about the relay
+	}
+
+	var previous, updated models.SeedRelay
+	err := db.Update(func(txn *badger.Txn) error {
+		var err error
+		if previous, err = getSeedRelayTxn(txn, url); err != nil {
+			return err
+		}
+		updated = previous
+		updated.LastCheckedTime = time.Now().Unix()
+		if probeErr != nil {
+			updated.ConsecutiveFailures++
+			updated.LastError = probeErr.Error()
+		} else {
+			updated.ConsecutiveFailures = 0
+			updated.LastError = ""
+			updated.LastSuccessTime = updated.LastCheckedTime
+			updated.LatencyMs = latency.Milliseconds()
+		}
+		return putSeedRelayTxn(txn, updated)
+	})
+	if errors.Is(err, ErrSeedRelayNotFound) {
+		return // deleted meanwhile
+	} else if err != nil {
+		log.Printf("[ERROR] saving probe of %s: %s", url, err)
+		return
+	}
+
+	if probeErr != nil {
+		metrics.SeedRelayUp.WithLabelValues(url).Set(0)
+		log.Printf("[DEBUG] probe of seed relay %s failed: %s", url, probeErr)
+	} else {
+		metrics.SeedRelayUp.WithLabelValues(url).Set(1)
+		metrics.SeedRelayLatency.WithLabelValues(url).Set(latency.Seconds())
+	}
+
+	switch {
+	case updated.Dead() && !previous.Dead():
+		log.Printf("[WARN] seed relay %s is down, skipping it until it answers again: %s", url, probeErr)
+		seedRelaysUpdated()
+	case previous.Dead() && !updated.Dead():
+		log.Printf("[INFO] seed relay %s is back after %d failed probes", url, previous.ConsecutiveFailures)
+		seedRelaysUpdated()
+	default:
+		if err := loadSeedRelays(); err != nil {
+			log.Printf("[ERROR] loading seed relays: %s", err)
+		}
+	}
+}
+
+// migrateSeedRelays imports SEED_RELAYS_PATH into the registry, with both
+// roles. A missing file leaves the registry without seed relays, to be added
+// on the web page. An unreadable or malformed file is an error.
+func migrateSeedRelays() error {
+	urls, err := helpers.GetRelayListFromFile(s.SeedRelaysPath)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("[WARN] no %s to import seed relays from", s.SeedRelaysPath)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	err = db.Update(func(txn *badger.Txn) error {
+		for _, url := range urls {
+			if err := putSeedRelayTxn(txn, models.SeedRelay{URL: url, Read: true, Write: true, AddedTime: now}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] imported %d seed relays from %s", len(urls), s.SeedRelaysPath)
+	return nil
+}
@@ -0,0 +1,116 @@
+package relays
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"rssnotes/internal/yarr/yarrparser"
+	"slices"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// registrySeenPrefix keys hold, per feed pubkey, the keys of the items that
+// were already published, oldest first.
+const registrySeenPrefix byte = 131
+
+func registrySeenKey(pubkeyHex string) []byte {
+	return append([]byte{registrySeenPrefix}, []byte(pubkeyHex)...)
+}
+
+// itemSeenKey identifies a feed item by its GUID, or by link and title when
+// the feed does not provide one.
+func itemSeenKey(item *yarrparser.Item) string {
+	id := item.GUID
+	if id == "" {
+		id = item.URL + "\n" + item.Title
+	}
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:16])
+}
+
+// itemVersionKey changes whenever the title or content of an item changes,
+// so that long-form feeds can republish edited items. It starts with the
+// seen key of the item, see versionedItems.
+func itemVersionKey(item *yarrparser.Item) string {
+	sum := sha256.Sum256([]byte(item.GUID + "\n" + item.URL + "\n" + item.Title + "\n" + item.Summary + "\n" + item.Content))
+	return "v" + itemSeenKey(item) + ":" + hex.EncodeToString(sum[:16])
+}
+
+// versionedItems returns the seen keys of the items that have a version key
+// in the seen set. Items published before the feed switched to long-form
+// output have none.
+func versionedItems(seenItems map[string]bool) map[string]bool {
+	versioned := make(map[string]bool)
+	for k := range seenItems {
+		if itemKey, _, ok := strings.Cut(strings.TrimPrefix(k, "v"), ":"); ok && strings.HasPrefix(k, "v") {
+			versioned[itemKey] = true
+		}
+	}
+	return versioned
+}
+
+func getSeenItemsTxn(txn *badger.Txn, pubkeyHex string) ([]string, bool, error) {
+	item, err := txn.Get(registrySeenKey(pubkeyHex))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	var seenKeys []string
+	if err := item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &seenKeys)
+	}); err != nil {
+		return nil, false, err
+	}
+	return seenKeys, true, nil
+}
+
+// getSeenItems returns the seen set of a feed. exists is false for feeds
+// that were never checked with a seen set.
+func getSeenItems(pubkeyHex string) (seen map[string]bool, exists bool, err error) {
+	err = db.View(func(txn *badger.Txn) error {
+		seenKeys, found, err := getSeenItemsTxn(txn, pubkeyHex)
+		if err != nil {
+			return err
+		}
+		exists = found
+		seen = make(map[string]bool, len(seenKeys))
+		for _, k := range seenKeys {
+			seen[k] = true
+		}
+		return nil
+	})
+	return seen, exists, err
+}
+
+// markItemsSeen moves itemKeys to the newest end of the seen set and drops
+// the oldest keys above MaxSeenItemsPerFeed. Keys still in the feed are
+// never dropped.
+func markItemsSeen(pubkeyHex string, itemKeys []string) error {
+	return updateTxn(func(txn *badger.Txn) error {
+		seenKeys, _, err := getSeenItemsTxn(txn, pubkeyHex)
+		if err != nil {
+			return err
+		}
+
+		seenKeys = slices.DeleteFunc(seenKeys, func(k string) bool {
+			return slices.Contains(itemKeys, k)
+		})
+		seenKeys = append(seenKeys, itemKeys...)
+
+		limit := max(s.MaxSeenItemsPerFeed, len(itemKeys))
+		if len(seenKeys) > limit {
+			seenKeys = seenKeys[len(seenKeys)-limit:]
+		}
+
+		seenBytes, err := json.Marshal(seenKeys)
+		if err != nil {
+			return err
+		}
+		return txn.Set(registrySeenKey(pubkeyHex), seenBytes)
+	})
+}
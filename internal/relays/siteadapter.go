@@ -0,0 +1,111 @@
+package relays
+
+import (
+	"net/url"
+	"rssnotes/internal/yarr/yarrparser"
+	"strings"
+)
+
+// SiteAdapter tailors the profile and the notes of feeds from one site.
+// Adapters only rewrite what the generic feed handling produced, so a site
+// without an adapter still gets sensible notes.
+type SiteAdapter interface {
+	// Name identifies the adapter.
+	Name() string
+	// Match reports whether the feed belongs to the site.
+	Match(feed *yarrparser.Feed) bool
+	// Profile rewrites the profile metadata of the feed.
+	Profile(feed *yarrparser.Feed, profile *FeedProfile)
+	// Note rewrites the content, links and tags of an item before the note
+	// template renders it.
+	Note(item *yarrparser.Item, feed *yarrparser.Feed, data *NoteData)
+}
+
+// FeedProfile is the kind 0 metadata of a feed profile.
+type FeedProfile struct {
+	Name    string // shown with an " (RSS Feed)" suffix
+	About   string
+	Website string
+	Picture string
+}
+
+// baseSiteAdapter leaves everything as is. Adapters embed it and override
+// what they need.
+type baseSiteAdapter struct{}
+
+func (baseSiteAdapter) Name() string                                       { return "generic" }
+func (baseSiteAdapter) Match(*yarrparser.Feed) bool                        { return true }
+func (baseSiteAdapter) Profile(*yarrparser.Feed, *FeedProfile)             {}
+func (baseSiteAdapter) Note(*yarrparser.Item, *yarrparser.Feed, *NoteData) {}
+
+var siteAdapters = []SiteAdapter{
+	redditAdapter{},
+	stackerNewsAdapter{},
+	hackerNewsAdapter{},
+	youtubeAdapter{},
+	githubAdapter{},
+	mastodonAdapter{},
+}
+
+// RegisterSiteAdapter adds an adapter ahead of the built-in ones, so it can
+// also replace one of them. Call it before the relay starts.
+func RegisterSiteAdapter(adapter SiteAdapter) {
+	siteAdapters = append([]SiteAdapter{adapter}, siteAdapters...)
+}
+
+// siteAdapterFor returns the first adapter matching the feed.
+func siteAdapterFor(feed *yarrparser.Feed) SiteAdapter {
+	for _, adapter := range siteAdapters {
+		if adapter.Match(feed) {
+			return adapter
+		}
+	}
+	return baseSiteAdapter{}
+}
+
+// feedProfile builds the profile of a feed and lets its adapter rewrite it.
+func feedProfile(feed *yarrparser.Feed) FeedProfile {
+	profile := FeedProfile{
+		Name:    feed.Title,
+		About:   feed.Description,
+		Website: feed.SiteURL,
+		Picture: feed.ImageURL,
+	}
+	siteAdapterFor(feed).Profile(feed, &profile)
+	return profile
+}
+
+// hostIs reports whether the host of rawURL is one of domains or a
+// subdomain of one.
+func hostIs(rawURL string, domains ...string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// feedHostIs matches the site url or the feed url of a feed.
+func feedHostIs(feed *yarrparser.Feed, domains ...string) bool {
+	return hostIs(feed.SiteURL, domains...) || hostIs(feed.FeedURL, domains...)
+}
+
+// prependHashtag puts tag first in the hashtags of a note, once.
+func prependHashtag(data *NoteData, tag string) {
+	if tag = NormalizeHashtag(tag); tag == "" {
+		return
+	}
+	tags := []string{tag}
+	for _, t := range data.Tags {
+		if t != tag {
+			tags = append(tags, t)
+		}
+	}
+	data.Tags = tags
+}
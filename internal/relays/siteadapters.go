@@ -0,0 +1,188 @@
+package relays
+
+import (
+	"html"
+	"net/url"
+	"rssnotes/internal/yarr/yarrparser"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// redditAdapter names subreddit profiles /r/name and tags their notes with
+// the subreddit. Their summaries are not shown.
+type redditAdapter struct{ baseSiteAdapter }
+
+func (redditAdapter) Name() string { return "reddit" }
+
+func (redditAdapter) Match(feed *yarrparser.Feed) bool {
+	return feedHostIs(feed, "reddit.com")
+}
+
+func (redditAdapter) Profile(feed *yarrparser.Feed, profile *FeedProfile) {
+	if subreddit := subredditOf(feed); subreddit != "" {
+		profile.Name = "/r/" + subreddit
+		profile.About += " #" + subreddit
+	}
+}
+
+func (redditAdapter) Note(item *yarrparser.Item, feed *yarrparser.Feed, data *NoteData) {
+	data.ShowSummary = false
+	if subreddit := NormalizeHashtag(subredditOf(feed)); subreddit != "" {
+		prependHashtag(data, subreddit)
+		data.Hashtags = []string{subreddit}
+	}
+}
+
+// subredditOf returns the subreddit name of a reddit feed, or "".
+func subredditOf(feed *yarrparser.Feed) string {
+	for _, link := range []string{feed.SiteURL, feed.FeedURL} {
+		if _, subreddit, found := strings.Cut(link, "/r/"); found {
+			subreddit, _, _ = strings.Cut(subreddit, "/")
+			subreddit, _, _ = strings.Cut(subreddit, ".")
+			return subreddit
+		}
+	}
+	return ""
+}
+
+// stackerNewsAdapter hides the summary of items, as rssnotes always has.
+type stackerNewsAdapter struct{ baseSiteAdapter }
+
+func (stackerNewsAdapter) Name() string { return "stacker.news" }
+
+func (stackerNewsAdapter) Match(feed *yarrparser.Feed) bool {
+	return feedHostIs(feed, "stacker.news")
+}
+
+func (stackerNewsAdapter) Note(item *yarrparser.Item, feed *yarrparser.Feed, data *NoteData) {
+	data.ShowSummary = false
+}
+
+// hackerNewsAdapter hides the summary, which is only the comments link or
+// the points of the story, and drops the comments link of Ask HN posts that
+// already link to the discussion.
+type hackerNewsAdapter struct{ baseSiteAdapter }
+
+func (hackerNewsAdapter) Name() string { return "hacker news" }
+
+func (hackerNewsAdapter) Match(feed *yarrparser.Feed) bool {
+	return feedHostIs(feed, "news.ycombinator.com", "hnrss.org")
+}
+
+func (hackerNewsAdapter) Note(item *yarrparser.Item, feed *yarrparser.Feed, data *NoteData) {
+	data.ShowSummary = false
+	if data.CommentsURL == data.Link {
+		data.CommentsURL = ""
+	}
+}
+
+// youtubeAdapter keeps the line breaks of video descriptions, which are
+// plain text.
+type youtubeAdapter struct{ baseSiteAdapter }
+
+func (youtubeAdapter) Name() string { return "youtube" }
+
+func (youtubeAdapter) Match(feed *yarrparser.Feed) bool {
+	return feedHostIs(feed, "youtube.com") && strings.Contains(feed.FeedURL, "/feeds/videos.xml")
+}
+
+func (youtubeAdapter) Profile(feed *yarrparser.Feed, profile *FeedProfile) {
+	if profile.About == "" {
+		profile.About = "Videos of " + feed.Title + " on YouTube"
+	}
+}
+
+func (youtubeAdapter) Note(item *yarrparser.Item, feed *yarrparser.Feed, data *NoteData) {
+	data.Summary = data.Text
+	data.Markdown = data.Text
+	data.ShowSummary = data.Text != ""
+}
+
+// githubAdapter names release, tag and commit feeds after their repository.
+// Commit notes show the commit subject only.
+type githubAdapter struct{ baseSiteAdapter }
+
+func (githubAdapter) Name() string { return "github" }
+
+func (githubAdapter) Match(feed *yarrparser.Feed) bool {
+	repo, kind := githubFeedOf(feed)
+	return repo != "" && kind != ""
+}
+
+func (githubAdapter) Profile(feed *yarrparser.Feed, profile *FeedProfile) {
+	repo, kind := githubFeedOf(feed)
+	profile.Name = repo + " " + kind
+	if profile.About == "" {
+		profile.About = "GitHub " + kind + " of " + repo
+	}
+}
+
+func (githubAdapter) Note(item *yarrparser.Item, feed *yarrparser.Feed, data *NoteData) {
+	repo, kind := githubFeedOf(feed)
+	switch kind {
+	case "commits":
+		data.ShowSummary = false
+	case "releases", "tags":
+		if !strings.Contains(data.Title, repo) {
+			data.Title = repo + " " + data.Title
+		}
+	}
+}
+
+// githubFeedOf returns the owner/repo and the kind of a GitHub atom feed.
+func githubFeedOf(feed *yarrparser.Feed) (repo, kind string) {
+	u, err := url.Parse(feed.FeedURL)
+	if err != nil || !hostIs(feed.FeedURL, "github.com") || !strings.HasSuffix(u.Path, ".atom") {
+		return "", ""
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimSuffix(u.Path, ".atom"), "/"), "/")
+	if len(parts) < 3 {
+		return "", ""
+	}
+	switch parts[2] {
+	case "releases", "tags", "commits":
+		return parts[0] + "/" + parts[1], parts[2]
+	}
+	return "", ""
+}
+
+// mastodonAdapter cleans up the html of posts: hashtag and mention links
+// become plain text and shortened links lose their hidden parts.
+type mastodonAdapter struct{ baseSiteAdapter }
+
+func (mastodonAdapter) Name() string { return "mastodon" }
+
+func (mastodonAdapter) Match(feed *yarrparser.Feed) bool {
+	u, err := url.Parse(feed.FeedURL)
+	if err != nil || !strings.HasSuffix(u.Path, ".rss") {
+		return false
+	}
+	return strings.HasPrefix(u.Path, "/@") || strings.HasPrefix(u.Path, "/users/") || strings.HasPrefix(u.Path, "/tags/")
+}
+
+func (mastodonAdapter) Note(item *yarrparser.Item, feed *yarrparser.Feed, data *NoteData) {
+	markdown := html.UnescapeString(toMarkdown(mastodonHTML(firstNonEmpty(item.Content, item.Summary)), item.URL))
+	data.Summary = markdown
+	data.Markdown = markdown
+}
+
+func mastodonHTML(postHTML string) string {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(postHTML))
+	if err != nil {
+		return postHTML
+	}
+
+	doc.Find("span.invisible").Remove()
+	doc.Find("span.ellipsis").AppendHtml("…")
+	doc.Find("a.mention, a.hashtag").Each(func(_ int, link *goquery.Selection) {
+		link.ReplaceWithHtml(html.EscapeString(link.Text()))
+	})
+
+	cleaned, err := doc.Find("body").Html()
+	if err != nil {
+		return postHTML
+	}
+	return cleaned
+}
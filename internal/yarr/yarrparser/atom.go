@@ -9,27 +9,46 @@ import (
 	htmlutil "rssnotes/internal/yarr/yarrhtmlutil"
 )
 
+const atomNamespace = "http://www.w3.org/2005/Atom"
+
 type atomFeed struct {
-	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
-	ID      string      `xml:"id"`
-	Title   atomText    `xml:"title"`
-	Links   atomLinks   `xml:"link"`
-	Entries []atomEntry `xml:"entry"`
+	XMLName  xml.Name     `xml:"http://www.w3.org/2005/Atom feed"`
+	ID       string       `xml:"id"`
+	Title    atomText     `xml:"title"`
+	Subtitle atomText     `xml:"subtitle"`
+	Logo     string       `xml:"logo"`
+	Icon     string       `xml:"icon"`
+	Authors  []atomPerson `xml:"author"`
+	Links    atomLinks    `xml:"link"`
+	Entries  []atomEntry  `xml:"entry"`
 }
 
 type atomEntry struct {
-	ID        string    `xml:"id"`
-	Title     atomText  `xml:"title"`
-	Summary   atomText  `xml:"summary"`
-	Published string    `xml:"published"`
-	Updated   string    `xml:"updated"`
-	Links     atomLinks `xml:"link"`
-	Content   atomText  `xml:"http://www.w3.org/2005/Atom content"`
-	OrigLink  string    `xml:"http://rssnamespace.org/feedburner/ext/1.0 origLink"`
+	ID         string         `xml:"id"`
+	Title      atomText       `xml:"title"`
+	Summary    atomText       `xml:"summary"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Links      atomLinks      `xml:"link"`
+	Content    atomText       `xml:"http://www.w3.org/2005/Atom content"`
+	Authors    []atomPerson   `xml:"author"`
+	Categories []atomCategory `xml:"category"`
+	OrigLink   string         `xml:"http://rssnamespace.org/feedburner/ext/1.0 origLink"`
 
 	media
 }
 
+type atomPerson struct {
+	Name  string `xml:"name"`
+	Email string `xml:"email"`
+	URI   string `xml:"uri"`
+}
+
+type atomCategory struct {
+	Term  string `xml:"term,attr"`
+	Label string `xml:"label,attr"`
+}
+
 type atomText struct {
 	Type string `xml:"type,attr"`
 	Data string `xml:",chardata"`
@@ -37,8 +56,11 @@ type atomText struct {
 }
 
 type atomLink struct {
-	Href string `xml:"href,attr"`
-	Rel  string `xml:"rel,attr"`
+	Href   string `xml:"href,attr"`
+	Rel    string `xml:"rel,attr"`
+	Type   string `xml:"type,attr"`
+	Length string `xml:"length,attr"`
+	Title  string `xml:"title,attr"`
 }
 
 type atomLinks []atomLink
@@ -69,6 +91,28 @@ func (links atomLinks) First(rel string) string {
 	return ""
 }
 
+func (links atomLinks) All(rel string) []atomLink {
+	all := make([]atomLink, 0)
+	for _, l := range links {
+		if l.Rel == rel {
+			all = append(all, l)
+		}
+	}
+	return all
+}
+
+func atomAuthors(persons []atomPerson) []Author {
+	authors := make([]Author, 0, len(persons))
+	for _, p := range persons {
+		authors = append(authors, Author{
+			Name:  strings.TrimSpace(p.Name),
+			Email: strings.TrimSpace(p.Email),
+			URL:   strings.TrimSpace(p.URI),
+		})
+	}
+	return authors
+}
+
 func ParseAtom(r io.Reader) (*Feed, error) {
 	srcfeed := atomFeed{}
 
@@ -78,26 +122,55 @@ func ParseAtom(r io.Reader) (*Feed, error) {
 	}
 
 	dstfeed := &Feed{
-		Title:   srcfeed.Title.String(),
-		SiteURL: firstNonEmpty(srcfeed.Links.First("alternate"), srcfeed.Links.First("")),
+		Title:       srcfeed.Title.String(),
+		SiteURL:     firstNonEmpty(srcfeed.Links.First("alternate"), srcfeed.Links.First("")),
+		FeedURL:     srcfeed.Links.First("self"),
+		Description: srcfeed.Subtitle.Text(),
+		ImageURL:    firstNonEmpty(srcfeed.Logo, srcfeed.Icon),
+		Authors:     atomAuthors(srcfeed.Authors),
 	}
 	for _, srcitem := range srcfeed.Entries {
 		linkFromID := ""
-		guidFromID := ""
 		if htmlutil.IsAPossibleLink(srcitem.ID) {
 			linkFromID = srcitem.ID
-			guidFromID = srcitem.ID + "::" + srcitem.Updated
 		}
 
+		enclosures := make([]Enclosure, 0)
+		for _, l := range srcitem.Links.All("enclosure") {
+			enclosures = append(enclosures, Enclosure{
+				URL:    l.Href,
+				Type:   l.Type,
+				Length: parseLength(l.Length),
+				Title:  l.Title,
+			})
+		}
+
+		categories := make([]string, 0, len(srcitem.Categories))
+		for _, c := range srcitem.Categories {
+			if category := firstNonEmpty(c.Label, c.Term); category != "" {
+				categories = append(categories, category)
+			}
+		}
+
+		enclosures = append(enclosures, srcitem.mediaEnclosures()...)
+		thumbnail := srcitem.firstMediaThumbnail()
+
 		link := firstNonEmpty(srcitem.OrigLink, srcitem.Links.First("alternate"), srcitem.Links.First(""), linkFromID)
 		dstfeed.Items = append(dstfeed.Items, Item{
-			GUID:     firstNonEmpty(guidFromID, srcitem.ID, link),
-			Date:     dateParse(firstNonEmpty(srcitem.Published, srcitem.Updated)),
-			URL:      link,
-			Title:    srcitem.Title.Text(),
-			Content:  firstNonEmpty(srcitem.Content.String(), srcitem.Summary.String(), srcitem.firstMediaDescription()),
-			ImageURL: srcitem.firstMediaThumbnail(),
-			AudioURL: "",
+			GUID:        firstNonEmpty(srcitem.ID, link),
+			Date:        dateParse(firstNonEmpty(srcitem.Published, srcitem.Updated)),
+			URL:         link,
+			Title:       srcitem.Title.Text(),
+			Summary:     firstNonEmpty(srcitem.Summary.String(), srcitem.firstMediaDescription()),
+			Content:     firstNonEmpty(srcitem.Content.String(), srcitem.Summary.String(), srcitem.firstMediaDescription()),
+			ImageURL:    thumbnail.URL,
+			ImageWidth:  parseDimension(thumbnail.Width),
+			ImageHeight: parseDimension(thumbnail.Height),
+			AudioURL:    firstAudioURL(enclosures),
+			Authors:     atomAuthors(srcitem.Authors),
+			Categories:  categories,
+			Enclosures:  enclosures,
+			CommentsURL: srcitem.Links.First("replies"),
 		})
 	}
 	return dstfeed, nil
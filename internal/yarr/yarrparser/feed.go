@@ -128,12 +128,35 @@ func ParseAndFix(r io.Reader, baseURL, fallbackEncoding string) (*Feed, error) {
 func (feed *Feed) cleanup() {
 	feed.Title = strings.TrimSpace(feed.Title)
 	feed.SiteURL = strings.TrimSpace(feed.SiteURL)
+	feed.FeedURL = strings.TrimSpace(feed.FeedURL)
+	feed.Description = strings.TrimSpace(htmlutil.ExtractText(feed.Description))
+	feed.ImageURL = strings.TrimSpace(feed.ImageURL)
 
 	for i, item := range feed.Items {
 		feed.Items[i].GUID = strings.TrimSpace(item.GUID)
 		feed.Items[i].URL = strings.TrimSpace(item.URL)
 		feed.Items[i].Title = strings.TrimSpace(htmlutil.ExtractText(item.Title))
+		feed.Items[i].Summary = strings.TrimSpace(item.Summary)
 		feed.Items[i].Content = strings.TrimSpace(item.Content)
+		feed.Items[i].CommentsURL = strings.TrimSpace(item.CommentsURL)
+
+		categories := make([]string, 0, len(item.Categories))
+		for _, c := range item.Categories {
+			if c = strings.TrimSpace(c); c != "" {
+				categories = append(categories, c)
+			}
+		}
+		feed.Items[i].Categories = categories
+
+		enclosures := make([]Enclosure, 0, len(item.Enclosures))
+		for _, e := range item.Enclosures {
+			e.URL = strings.TrimSpace(e.URL)
+			e.Type = strings.ToLower(strings.TrimSpace(e.Type))
+			if e.URL != "" {
+				enclosures = append(enclosures, e)
+			}
+		}
+		feed.Items[i].Enclosures = enclosures
 
 		if item.ImageURL != "" && strings.Contains(item.Content, item.ImageURL) {
 			feed.Items[i].ImageURL = ""
@@ -162,12 +185,34 @@ func (feed *Feed) TranslateURLs(base string) error {
 		return fmt.Errorf("failed to parse feed url: %#v", feed.SiteURL)
 	}
 	feed.SiteURL = baseUrl.ResolveReference(siteUrl).String()
-	for _, item := range feed.Items {
-		itemUrl, err := url.Parse(item.URL)
+	siteUrl, _ = url.Parse(feed.SiteURL)
+
+	resolve := func(link string) string {
+		if link == "" {
+			return ""
+		}
+		linkUrl, err := url.Parse(link)
 		if err != nil {
-			return fmt.Errorf("failed to parse item url: %#v", item.URL)
+			return link
+		}
+		return siteUrl.ResolveReference(linkUrl).String()
+	}
+
+	feed.ImageURL = resolve(feed.ImageURL)
+	for i, item := range feed.Items {
+		if item.URL != "" {
+			itemUrl, err := url.Parse(item.URL)
+			if err != nil {
+				return fmt.Errorf("failed to parse item url: %#v", item.URL)
+			}
+			feed.Items[i].URL = siteUrl.ResolveReference(itemUrl).String()
+		}
+		feed.Items[i].ImageURL = resolve(item.ImageURL)
+		feed.Items[i].AudioURL = resolve(item.AudioURL)
+		feed.Items[i].CommentsURL = resolve(item.CommentsURL)
+		for j, e := range item.Enclosures {
+			feed.Items[i].Enclosures[j].URL = resolve(e.URL)
 		}
-		item.URL = siteUrl.ResolveReference(itemUrl).String()
 	}
 	return nil
 }
@@ -175,7 +220,8 @@ func (feed *Feed) TranslateURLs(base string) error {
 func (feed *Feed) SetMissingGUIDs() {
 	for i, item := range feed.Items {
 		if item.GUID == "" {
-			id := strings.Join([]string{item.Title, item.Date.Format(time.RFC3339), item.URL}, ";;")
+			// no date here, missing dates are set to the time of the fetch
+			id := strings.Join([]string{item.Title, item.URL}, ";;")
 			feed.Items[i].GUID = fmt.Sprintf("%x", sha256.Sum256([]byte(id)))
 		}
 	}
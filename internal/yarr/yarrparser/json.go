@@ -1,4 +1,4 @@
-// JSON 1.0 parser
+// JSON 1.0 and 1.1 parser
 package yarrparser
 
 import (
@@ -7,24 +7,42 @@ import (
 )
 
 type jsonFeed struct {
-	Version string     `json:"version"`
-	Title   string     `json:"title"`
-	SiteURL string     `json:"home_page_url"`
-	Items   []jsonItem `json:"items"`
+	Version     string       `json:"version"`
+	Title       string       `json:"title"`
+	SiteURL     string       `json:"home_page_url"`
+	FeedURL     string       `json:"feed_url"`
+	Description string       `json:"description"`
+	Icon        string       `json:"icon"`
+	Favicon     string       `json:"favicon"`
+	Author      *jsonAuthor  `json:"author"`
+	Authors     []jsonAuthor `json:"authors"`
+	Items       []jsonItem   `json:"items"`
 }
 
 type jsonItem struct {
 	ID            string           `json:"id"`
 	URL           string           `json:"url"`
+	ExternalURL   string           `json:"external_url"`
 	Title         string           `json:"title"`
 	Summary       string           `json:"summary"`
 	Text          string           `json:"content_text"`
 	HTML          string           `json:"content_html"`
+	Image         string           `json:"image"`
+	BannerImage   string           `json:"banner_image"`
 	DatePublished string           `json:"date_published"`
 	DateModified  string           `json:"date_modified"`
+	Author        *jsonAuthor      `json:"author"`
+	Authors       []jsonAuthor     `json:"authors"`
+	Tags          []string         `json:"tags"`
 	Attachments   []jsonAttachment `json:"attachments"`
 }
 
+type jsonAuthor struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Avatar string `json:"avatar"`
+}
+
 type jsonAttachment struct {
 	URL      string `json:"url"`
 	MimeType string `json:"mime_type"`
@@ -33,6 +51,18 @@ type jsonAttachment struct {
 	Duration int    `json:"duration_in_seconds"`
 }
 
+// 1.1 replaced author with authors, accept both
+func jsonAuthors(author *jsonAuthor, authors []jsonAuthor) []Author {
+	all := make([]Author, 0, len(authors)+1)
+	for _, a := range authors {
+		all = append(all, Author{Name: a.Name, URL: a.URL})
+	}
+	if len(all) == 0 && author != nil {
+		all = append(all, Author{Name: author.Name, URL: author.URL})
+	}
+	return all
+}
+
 func ParseJSON(data io.Reader) (*Feed, error) {
 	srcfeed := new(jsonFeed)
 	decoder := json.NewDecoder(data)
@@ -41,16 +71,36 @@ func ParseJSON(data io.Reader) (*Feed, error) {
 	}
 
 	dstfeed := &Feed{
-		Title:   srcfeed.Title,
-		SiteURL: srcfeed.SiteURL,
+		Title:       srcfeed.Title,
+		SiteURL:     srcfeed.SiteURL,
+		FeedURL:     srcfeed.FeedURL,
+		Description: srcfeed.Description,
+		ImageURL:    firstNonEmpty(srcfeed.Icon, srcfeed.Favicon),
+		Authors:     jsonAuthors(srcfeed.Author, srcfeed.Authors),
 	}
 	for _, srcitem := range srcfeed.Items {
+		enclosures := make([]Enclosure, 0, len(srcitem.Attachments))
+		for _, a := range srcitem.Attachments {
+			enclosures = append(enclosures, Enclosure{
+				URL:    a.URL,
+				Type:   a.MimeType,
+				Length: a.Size,
+				Title:  a.Title,
+			})
+		}
+
 		dstfeed.Items = append(dstfeed.Items, Item{
-			GUID:    firstNonEmpty(srcitem.ID, srcitem.URL),
-			Date:    dateParse(firstNonEmpty(srcitem.DatePublished, srcitem.DateModified)),
-			URL:     srcitem.URL,
-			Title:   srcitem.Title,
-			Content: firstNonEmpty(srcitem.HTML, srcitem.Text, srcitem.Summary),
+			GUID:       firstNonEmpty(srcitem.ID, srcitem.URL),
+			Date:       dateParse(firstNonEmpty(srcitem.DatePublished, srcitem.DateModified)),
+			URL:        firstNonEmpty(srcitem.URL, srcitem.ExternalURL),
+			Title:      srcitem.Title,
+			Summary:    srcitem.Summary,
+			Content:    firstNonEmpty(srcitem.HTML, srcitem.Text, srcitem.Summary),
+			ImageURL:   firstNonEmpty(srcitem.Image, srcitem.BannerImage),
+			AudioURL:   firstAudioURL(enclosures),
+			Authors:    jsonAuthors(srcitem.Author, srcitem.Authors),
+			Categories: srcitem.Tags,
+			Enclosures: enclosures,
 		})
 	}
 	return dstfeed, nil
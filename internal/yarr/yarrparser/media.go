@@ -8,16 +8,25 @@ type media struct {
 }
 
 type mediaGroup struct {
+	MediaContents     []mediaContent     `xml:"http://search.yahoo.com/mrss/ content"`
 	MediaThumbnails   []mediaThumbnail   `xml:"http://search.yahoo.com/mrss/ thumbnail"`
 	MediaDescriptions []mediaDescription `xml:"http://search.yahoo.com/mrss/ description"`
 }
 
 type mediaContent struct {
+	URL             string           `xml:"url,attr"`
+	Type            string           `xml:"type,attr"`
+	Medium          string           `xml:"medium,attr"`
+	FileSize        string           `xml:"fileSize,attr"`
+	Width           string           `xml:"width,attr"`
+	Height          string           `xml:"height,attr"`
 	MediaThumbnails []mediaThumbnail `xml:"http://search.yahoo.com/mrss/ thumbnail"`
 }
 
 type mediaThumbnail struct {
-	URL string `xml:"url,attr"`
+	URL    string `xml:"url,attr"`
+	Width  string `xml:"width,attr"`
+	Height string `xml:"height,attr"`
 }
 
 type mediaDescription struct {
@@ -25,21 +34,21 @@ type mediaDescription struct {
 	Description string `xml:",chardata"`
 }
 
-func (m *media) firstMediaThumbnail() string {
+func (m *media) firstMediaThumbnail() mediaThumbnail {
 	for _, c := range m.MediaContents {
 		for _, t := range c.MediaThumbnails {
-			return t.URL
+			return t
 		}
 	}
 	for _, t := range m.MediaThumbnails {
-		return t.URL
+		return t
 	}
 	for _, g := range m.MediaGroups {
 		for _, t := range g.MediaThumbnails {
-			return t.URL
+			return t
 		}
 	}
-	return ""
+	return mediaThumbnail{}
 }
 
 func (m *media) firstMediaDescription() string {
@@ -53,3 +62,30 @@ func (m *media) firstMediaDescription() string {
 	}
 	return ""
 }
+
+func (m *media) mediaEnclosures() []Enclosure {
+	contents := make([]mediaContent, 0)
+	contents = append(contents, m.MediaContents...)
+	for _, g := range m.MediaGroups {
+		contents = append(contents, g.MediaContents...)
+	}
+
+	enclosures := make([]Enclosure, 0, len(contents))
+	for _, c := range contents {
+		if c.URL == "" {
+			continue
+		}
+		mimeType := c.Type
+		if mimeType == "" && c.Medium != "" {
+			mimeType = c.Medium + "/*"
+		}
+		enclosures = append(enclosures, Enclosure{
+			URL:    c.URL,
+			Type:   mimeType,
+			Length: parseLength(c.FileSize),
+			Width:  parseDimension(c.Width),
+			Height: parseDimension(c.Height),
+		})
+	}
+	return enclosures
+}
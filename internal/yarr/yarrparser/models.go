@@ -3,9 +3,13 @@ package yarrparser
 import "time"
 
 type Feed struct {
-	Title   string
-	SiteURL string
-	Items   []Item
+	Title       string
+	SiteURL     string
+	FeedURL     string
+	Description string
+	ImageURL    string
+	Authors     []Author
+	Items       []Item
 }
 
 type Item struct {
@@ -14,7 +18,30 @@ type Item struct {
 	URL   string
 	Title string
 
-	Content  string
-	ImageURL string
-	AudioURL string
+	Summary     string
+	Content     string
+	ImageURL    string
+	ImageWidth  int
+	ImageHeight int
+	AudioURL    string
+
+	Authors     []Author
+	Categories  []string
+	Enclosures  []Enclosure
+	CommentsURL string
+}
+
+type Author struct {
+	Name  string
+	Email string
+	URL   string
+}
+
+type Enclosure struct {
+	URL    string
+	Type   string
+	Length int64
+	Title  string
+	Width  int
+	Height int
 }
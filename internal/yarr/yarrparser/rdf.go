@@ -9,10 +9,12 @@ import (
 )
 
 type rdfFeed struct {
-	XMLName xml.Name  `xml:"RDF"`
-	Title   string    `xml:"channel>title"`
-	Link    string    `xml:"channel>link"`
-	Items   []rdfItem `xml:"item"`
+	XMLName     xml.Name  `xml:"RDF"`
+	Title       string    `xml:"channel>title"`
+	Link        string    `xml:"channel>link"`
+	Description string    `xml:"channel>description"`
+	ImageURL    string    `xml:"image>url"`
+	Items       []rdfItem `xml:"item"`
 }
 
 type rdfItem struct {
@@ -20,8 +22,10 @@ type rdfItem struct {
 	Link        string `xml:"link"`
 	Description string `xml:"description"`
 
-	DublinCoreDate string `xml:"http://purl.org/dc/elements/1.1/ date"`
-	ContentEncoded string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	DublinCoreDate     string   `xml:"http://purl.org/dc/elements/1.1/ date"`
+	DublinCoreCreators []string `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	DublinCoreSubjects []string `xml:"http://purl.org/dc/elements/1.1/ subject"`
+	ContentEncoded     string   `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
 }
 
 func ParseRDF(r io.Reader) (*Feed, error) {
@@ -33,16 +37,26 @@ func ParseRDF(r io.Reader) (*Feed, error) {
 	}
 
 	dstfeed := &Feed{
-		Title:   srcfeed.Title,
-		SiteURL: srcfeed.Link,
+		Title:       srcfeed.Title,
+		SiteURL:     srcfeed.Link,
+		Description: srcfeed.Description,
+		ImageURL:    srcfeed.ImageURL,
 	}
 	for _, srcitem := range srcfeed.Items {
+		authors := make([]Author, 0, len(srcitem.DublinCoreCreators))
+		for _, creator := range srcitem.DublinCoreCreators {
+			authors = append(authors, Author{Name: creator})
+		}
+
 		dstfeed.Items = append(dstfeed.Items, Item{
-			GUID:    srcitem.Link,
-			URL:     srcitem.Link,
-			Date:    dateParse(srcitem.DublinCoreDate),
-			Title:   srcitem.Title,
-			Content: firstNonEmpty(srcitem.ContentEncoded, srcitem.Description),
+			GUID:       srcitem.Link,
+			URL:        srcitem.Link,
+			Date:       dateParse(srcitem.DublinCoreDate),
+			Title:      srcitem.Title,
+			Summary:    srcitem.Description,
+			Content:    firstNonEmpty(srcitem.ContentEncoded, srcitem.Description),
+			Authors:    authors,
+			Categories: srcitem.DublinCoreSubjects,
 		})
 	}
 	return dstfeed, nil
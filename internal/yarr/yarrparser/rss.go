@@ -12,11 +12,13 @@ import (
 )
 
 type rssFeed struct {
-	XMLName xml.Name  `xml:"rss"`
-	Version string    `xml:"version,attr"`
-	Title   string    `xml:"channel>title"`
-	Link    string    `xml:"channel>link"`
-	Items   []rssItem `xml:"channel>item"`
+	XMLName     xml.Name  `xml:"rss"`
+	Version     string    `xml:"version,attr"`
+	Title       string    `xml:"channel>title"`
+	Links       []rssLink `xml:"channel>link"`
+	Description string    `xml:"channel>description"`
+	ImageURL    string    `xml:"channel>image>url"`
+	Items       []rssItem `xml:"channel>item"`
 }
 
 type rssItem struct {
@@ -26,9 +28,13 @@ type rssItem struct {
 	Description string         `xml:"rss description"`
 	PubDate     string         `xml:"pubDate"`
 	Enclosures  []rssEnclosure `xml:"enclosure"`
+	Author      string         `xml:"rss author"`
+	Categories  []string       `xml:"rss category"`
+	Comments    string         `xml:"rss comments"`
 
-	DublinCoreDate string `xml:"http://purl.org/dc/elements/1.1/ date"`
-	ContentEncoded string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	DublinCoreDate     string   `xml:"http://purl.org/dc/elements/1.1/ date"`
+	DublinCoreCreators []string `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	ContentEncoded     string   `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
 
 	OrigLink          string `xml:"http://rssnamespace.org/feedburner/ext/1.0 origLink"`
 	OrigEnclosureLink string `xml:"http://rssnamespace.org/feedburner/ext/1.0 origEnclosureLink"`
@@ -70,20 +76,28 @@ func ParseRSS(r io.Reader) (*Feed, error) {
 	}
 
 	dstfeed := &Feed{
-		Title:   srcfeed.Title,
-		SiteURL: srcfeed.Link,
+		Title:       srcfeed.Title,
+		SiteURL:     srcfeed.siteLink(),
+		FeedURL:     srcfeed.selfLink(),
+		Description: srcfeed.Description,
+		ImageURL:    srcfeed.ImageURL,
 	}
 	for _, srcitem := range srcfeed.Items {
 		podcastURL := ""
+		enclosures := make([]Enclosure, 0, len(srcitem.Enclosures))
 		for _, e := range srcitem.Enclosures {
-			if strings.HasPrefix(e.Type, "audio/") {
-				podcastURL = e.URL
-
-				if srcitem.OrigEnclosureLink != "" && strings.Contains(podcastURL, path.Base(srcitem.OrigEnclosureLink)) {
-					podcastURL = srcitem.OrigEnclosureLink
-				}
-				break
+			enclosureURL := e.URL
+			if srcitem.OrigEnclosureLink != "" && strings.Contains(enclosureURL, path.Base(srcitem.OrigEnclosureLink)) {
+				enclosureURL = srcitem.OrigEnclosureLink
+			}
+			if podcastURL == "" && strings.HasPrefix(e.Type, "audio/") {
+				podcastURL = enclosureURL
 			}
+			enclosures = append(enclosures, Enclosure{
+				URL:    enclosureURL,
+				Type:   e.Type,
+				Length: parseLength(e.Length),
+			})
 		}
 
 		permalink := ""
@@ -91,15 +105,65 @@ func ParseRSS(r io.Reader) (*Feed, error) {
 			permalink = srcitem.GUID.GUID
 		}
 
+		thumbnail := srcitem.firstMediaThumbnail()
+
+		authors := make([]Author, 0)
+		if srcitem.Author != "" {
+			authors = append(authors, parseRSSAuthor(srcitem.Author))
+		}
+		for _, creator := range srcitem.DublinCoreCreators {
+			authors = append(authors, Author{Name: creator})
+		}
+
 		dstfeed.Items = append(dstfeed.Items, Item{
-			GUID:     firstNonEmpty(srcitem.GUID.GUID, srcitem.Link),
-			Date:     dateParse(firstNonEmpty(srcitem.DublinCoreDate, srcitem.PubDate)),
-			URL:      firstNonEmpty(srcitem.OrigLink, srcitem.Link, permalink),
-			Title:    srcitem.Title,
-			Content:  firstNonEmpty(srcitem.ContentEncoded, srcitem.Description),
-			AudioURL: podcastURL,
-			ImageURL: srcitem.firstMediaThumbnail(),
+			GUID:        firstNonEmpty(srcitem.GUID.GUID, srcitem.Link),
+			Date:        dateParse(firstNonEmpty(srcitem.DublinCoreDate, srcitem.PubDate)),
+			URL:         firstNonEmpty(srcitem.OrigLink, srcitem.Link, permalink),
+			Title:       srcitem.Title,
+			Summary:     srcitem.Description,
+			Content:     firstNonEmpty(srcitem.ContentEncoded, srcitem.Description),
+			AudioURL:    podcastURL,
+			ImageURL:    thumbnail.URL,
+			ImageWidth:  parseDimension(thumbnail.Width),
+			ImageHeight: parseDimension(thumbnail.Height),
+			Authors:     authors,
+			Categories:  srcitem.Categories,
+			Enclosures:  append(enclosures, srcitem.mediaEnclosures()...),
+			CommentsURL: srcitem.Comments,
 		})
 	}
 	return dstfeed, nil
 }
+
+func (f *rssFeed) siteLink() string {
+	for _, l := range f.Links {
+		if l.XMLName.Space != atomNamespace && strings.TrimSpace(l.Data) != "" {
+			return l.Data
+		}
+	}
+	return ""
+}
+
+func (f *rssFeed) selfLink() string {
+	for _, l := range f.Links {
+		if l.XMLName.Space == atomNamespace && l.Rel == "self" {
+			return l.Href
+		}
+	}
+	return ""
+}
+
+// RSS <author> is an email address, optionally followed by a name in parentheses.
+func parseRSSAuthor(author string) Author {
+	author = strings.TrimSpace(author)
+	if i := strings.Index(author, "("); i > 0 && strings.HasSuffix(author, ")") {
+		return Author{
+			Email: strings.TrimSpace(author[:i]),
+			Name:  strings.TrimSpace(author[i+1 : len(author)-1]),
+		}
+	}
+	if strings.Contains(author, "@") && !strings.Contains(author, " ") {
+		return Author{Email: author}
+	}
+	return Author{Name: author}
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/xml"
 	"io"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"golang.org/x/net/html/charset"
@@ -21,6 +22,31 @@ func firstNonEmpty(vals ...string) string {
 	return ""
 }
 
+func parseLength(val string) int64 {
+	length, err := strconv.ParseInt(strings.TrimSpace(val), 10, 64)
+	if err != nil || length < 0 {
+		return 0
+	}
+	return length
+}
+
+func parseDimension(val string) int {
+	dimension, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(val), "px"))
+	if err != nil || dimension < 0 {
+		return 0
+	}
+	return dimension
+}
+
+func firstAudioURL(enclosures []Enclosure) string {
+	for _, e := range enclosures {
+		if strings.HasPrefix(e.Type, "audio/") {
+			return e.URL
+		}
+	}
+	return ""
+}
+
 var linkRe = regexp.MustCompile(`(https?:\/\/\S+)`)
 
 func plain2html(text string) string {
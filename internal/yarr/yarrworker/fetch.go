@@ -0,0 +1,60 @@
+package yarrworker
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+type FeedResponse struct {
+	Body         []byte
+	Charset      string
+	NotModified  bool
+	ETag         string
+	LastModified string
+}
+
+// HTTPStatusError is returned for any answer other than 200 or 304.
+type HTTPStatusError struct {
+	StatusCode int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("status code %d", e.StatusCode)
+}
+
+// GetFeed downloads a feed, sending the validators of the previous download
+// so that unchanged feeds answer with 304 and no body.
+func GetFeed(feedUrl, lastModified, etag string) (*FeedResponse, error) {
+	res, err := client.getConditional(feedUrl, lastModified, etag)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	result := &FeedResponse{
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+	}
+
+	switch {
+	case res.StatusCode == http.StatusNotModified:
+		result.NotModified = true
+		if result.ETag == "" {
+			result.ETag = etag
+		}
+		if result.LastModified == "" {
+			result.LastModified = lastModified
+		}
+		return result, nil
+	case res.StatusCode != http.StatusOK:
+		return nil, &HTTPStatusError{StatusCode: res.StatusCode}
+	}
+
+	result.Charset = getCharset(res)
+	result.Body, err = io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"rssnotes/internal/config"
 	"rssnotes/server"
@@ -43,10 +48,38 @@ func main() {
 
 	srvr := server.NewServer(c)
 
-	fmt.Printf("listening on 0.0.0.0:%s%s\n", srvr.Cfg.Port, srvr.GetAddr().Path)
-	fmt.Printf("public url (RELAY_URL) at %s\n", srvr.GetAddr().Scheme+"://"+srvr.GetAddr().Host+srvr.GetAddr().Path)
-	if err := http.ListenAndServe(":"+srvr.Cfg.Port, srvr.Serve()); err != nil {
-		fmt.Printf("ListenAndServe error %s", err)
-		log.Panicf("[FATAL] ListenAndServe error %s", err)
+	httpServer := &http.Server{
+		Addr:    ":" + srvr.Cfg.Port,
+		Handler: srvr.Serve(),
 	}
+	httpServer.RegisterOnShutdown(srvr.BeginShutdown)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		fmt.Printf("listening on 0.0.0.0:%s%s\n", srvr.Cfg.Port, srvr.GetAddr().Path)
+		fmt.Printf("public url (RELAY_URL) at %s\n", srvr.GetAddr().Scheme+"://"+srvr.GetAddr().Host+srvr.GetAddr().Path)
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("ListenAndServe error %s", err)
+			log.Panicf("[FATAL] ListenAndServe error %s", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	fmt.Println("shutting down...")
+	log.Print("[INFO] shutdown signal received")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(c.ShutdownTimeoutSecs)*time.Second)
+	defer cancel()
+
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("[WARN] http shutdown: %s", err)
+	}
+	if err := srvr.Shutdown(shutdownCtx); err != nil {
+		log.Printf("[WARN] relay shutdown: %s", err)
+	}
+
+	log.Print("[INFO] shutdown complete")
 }
@@ -66,6 +66,14 @@ var (
 		Name: "rssnotes_processed_kind_one_notes_deleted_total",
 		Help: "The total number of kind one notes deleted",
 	})
+	KindLongFormCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rssnotes_processed_kind_long_form_created_total",
+		Help: "The total number of long-form articles created or updated",
+	})
+	KindLongFormDeleted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rssnotes_processed_kind_long_form_deleted_total",
+		Help: "The total number of long-form articles deleted",
+	})
 	KindBookmarkNotesCreated = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "rssnotes_processed_kind_bookmark_notes_created_total",
 		Help: "The total number of kind bookmark notes created",
@@ -74,11 +82,35 @@ var (
 		Name: "rssnotes_processed_kind_bookmark_notes_deleted_total",
 		Help: "The total number of kind bookmark notes deleted",
 	})
+	DeletionRequestsCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rssnotes_processed_deletion_requests_created_total",
+		Help: "The total number of NIP-09 deletion requests created",
+	})
 
 	NotesBlasted = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "rssnotes_processed_notes_blasted_total",
 		Help: "The total number of notes blasted",
 	})
+	FeedsNotModified = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rssnotes_processed_feeds_not_modified_total",
+		Help: "The total number of feed checks answered with not modified",
+	})
+	FeedsFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rssnotes_processed_feeds_failed_total",
+		Help: "The total number of failed feed checks",
+	})
+	FeedsRetired = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rssnotes_processed_feeds_retired_total",
+		Help: "The total number of feeds deleted after failing too often",
+	})
+	SchedulerQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "rssnotes_scheduler_queue_depth",
+		Help: "Current number of feeds waiting in the scheduler queue",
+	})
+	SchedulerLagSeconds = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "rssnotes_scheduler_lag_seconds",
+		Help: "Seconds between the due time and the start of the last feed check",
+	})
 	CacheHits = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "rssnotes_processed_cache_hits_ops_total",
 		Help: "The total number of cache hits",
@@ -91,15 +123,23 @@ var (
 		Name: "rssnotes_errors_total",
 		Help: "Number of errors for the app.",
 	}, []string{"type"})
-	ReplayRoutineQueueLength = promauto.NewGauge(prometheus.GaugeOpts{
+	SeedRelayUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rssnotes_seed_relay_up",
+		Help: "1 when the last probe of a seed relay succeeded, by relay.",
+	}, []string{"relay"})
+	SeedRelayLatency = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rssnotes_seed_relay_latency_seconds",
+		Help: "Time to connect and query of the last successful probe, by relay.",
+	}, []string{"relay"})
+	ReplayRoutineQueueLength = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "rssnotes_replay_routines_queue_length",
-		Help: "Current number of subroutines to replay events to other relays",
-	})
-	ReplayEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Help: "Current number of events waiting in the outbox by relay.",
+	}, []string{"relay"})
+	ReplayEvents = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "rssnotes_replay_events_total",
 		Help: "Number of correct replayed events by relay.",
 	}, []string{"relay"})
-	ReplayErrorEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+	ReplayErrorEvents = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "rssnotes_replay_events_error_total",
 		Help: "Number of error replayed events by relay.",
 	}, []string{"relay"})
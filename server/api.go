@@ -0,0 +1,507 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"rssnotes/internal/config"
+	"rssnotes/internal/helpers"
+	"rssnotes/internal/models"
+	"rssnotes/internal/relays"
+	"rssnotes/metrics"
+	"rssnotes/server/router"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	apiPrefix = "/api/v1"
+
+	defaultAPIPageSize = 50
+	maxAPIPageSize     = 500
+)
+
+// apiFeed is the JSON form of a feed. It never carries the private key.
+type apiFeed struct {
+	PubKey          string            `json:"pubkey"`
+	NPubKey         string            `json:"npub"`
+	NProfile        string            `json:"nprofile"`
+	URL             string            `json:"url"`
+	Title           string            `json:"title,omitempty"`
+	SiteURL         string            `json:"site_url,omitempty"`
+	Categories      []string          `json:"categories,omitempty"`
+	ImageURL        string            `json:"image_url"`
+	NoteTemplate    string            `json:"note_template,omitempty"`
+	OutputMode      models.OutputMode `json:"output_mode"`
+	HashtagAllow    []string          `json:"hashtag_allow,omitempty"`
+	HashtagDeny     []string          `json:"hashtag_deny,omitempty"`
+	AppendHashtags  bool              `json:"append_hashtags"`
+	Paused          bool              `json:"paused"`
+	LocalOnly       bool              `json:"local_only"`
+	NIP05           string            `json:"nip05,omitempty"`
+	LastPostTime    int64             `json:"last_post_time"`
+	LastCheckedTime int64             `json:"last_checked_time"`
+	NextCheckTime   int64             `json:"next_check_time"`
+	AvgPostTime     int64             `json:"avg_post_time"`
+	Health          apiFeedHealth     `json:"health"`
+}
+
+type apiFeedHealth struct {
+	ConsecutiveFailures int                   `json:"consecutive_failures"`
+	LastErrorClass      models.FeedErrorClass `json:"last_error_class,omitempty"`
+	LastError           string                `json:"last_error,omitempty"`
+	LastSuccessTime     int64                 `json:"last_success_time"`
+}
+
+// apiSeedRelay is the JSON form of a seed relay.
+type apiSeedRelay struct {
+	URL                 string `json:"url"`
+	Read                bool   `json:"read"`
+	Write               bool   `json:"write"`
+	Alive               bool   `json:"alive"`
+	AddedTime           int64  `json:"added_time"`
+	LastCheckedTime     int64  `json:"last_checked_time"`
+	LastSuccessTime     int64  `json:"last_success_time"`
+	LatencyMs           int64  `json:"latency_ms"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	LastError           string `json:"last_error,omitempty"`
+}
+
+func newAPISeedRelay(relay models.SeedRelay) apiSeedRelay {
+	return apiSeedRelay{
+		URL:                 relay.URL,
+		Read:                relay.Read,
+		Write:               relay.Write,
+		Alive:               !relay.Dead(),
+		AddedTime:           relay.AddedTime,
+		LastCheckedTime:     relay.LastCheckedTime,
+		LastSuccessTime:     relay.LastSuccessTime,
+		LatencyMs:           relay.LatencyMs,
+		ConsecutiveFailures: relay.ConsecutiveFailures,
+		LastError:           relay.LastError,
+	}
+}
+
+func newAPIFeed(entity models.Entity) apiFeed {
+	npub, _ := nip19.EncodePublicKey(entity.PubKey)
+	return apiFeed{
+		PubKey:          entity.PubKey,
+		NPubKey:         npub,
+		NProfile:        relays.NProfile(entity.PubKey),
+		URL:             entity.URL,
+		Title:           entity.Title,
+		SiteURL:         entity.SiteURL,
+		Categories:      entity.Categories,
+		ImageURL:        entity.ImageURL,
+		NoteTemplate:    entity.NoteTemplate,
+		OutputMode:      entity.OutputMode,
+		HashtagAllow:    entity.HashtagAllow,
+		HashtagDeny:     entity.HashtagDeny,
+		AppendHashtags:  entity.AppendHashtags,
+		Paused:          entity.Paused,
+		LocalOnly:       entity.LocalOnly,
+		NIP05:           relays.NIP05Identifier(entity.NIP05Name),
+		LastPostTime:    entity.LastPostTime,
+		LastCheckedTime: entity.LastCheckedTime,
+		NextCheckTime:   helpers.NextFeedUpdate(entity),
+		AvgPostTime:     entity.AvgPostTime,
+		Health: apiFeedHealth{
+			ConsecutiveFailures: entity.ConsecutiveFailures,
+			LastErrorClass:      entity.LastErrorClass,
+			LastError:           entity.LastError,
+			LastSuccessTime:     entity.LastSuccessTime,
+		},
+	}
+}
+
+func (s *Server) apiRoutes(r *router.Router) {
+	r.For(apiPrefix+"/feeds", s.handleAPIFeeds)
+	r.For(apiPrefix+"/feeds/:pubkey", s.handleAPIFeed)
+	r.For(apiPrefix+"/feeds/:pubkey/refresh", handleAPIRefreshFeed)
+	r.For(apiPrefix+"/feeds/:pubkey/categories", handleAPIFeedCategories)
+	r.For(apiPrefix+"/import", s.handleAPIImport)
+	r.For(apiPrefix+"/export", s.handleAPIExport)
+	r.For(apiPrefix+"/stats", s.handleAPIStats)
+	r.For(apiPrefix+"/relays", handleAPIRelays)
+}
+
+func apiError(c *router.Context, status int, message string) {
+	c.JSON(status, map[string]string{"error": message})
+}
+
+// apiMethods answers 405 unless the request uses one of methods.
+func apiMethods(c *router.Context, methods ...string) bool {
+	for _, method := range methods {
+		if c.Req.Method == method {
+			return true
+		}
+	}
+	c.Out.Header().Set("Allow", strings.Join(methods, ", "))
+	apiError(c, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+// apiPubkey reads the feed pubkey from the path, as hex or npub.
+func apiPubkey(c *router.Context) string {
+	if pubkey := relays.DecodePubkey(c.Vars["pubkey"]); pubkey != "" {
+		return pubkey
+	}
+	return c.Vars["pubkey"]
+}
+
+// handleAPIFeeds lists feeds page by page on GET and creates a feed from a
+// url on POST.
+func (s *Server) handleAPIFeeds(c *router.Context) {
+	if !apiMethods(c, http.MethodGet, http.MethodPost) {
+		return
+	}
+	if c.Req.Method == http.MethodPost {
+		s.apiCreateFeed(c)
+		return
+	}
+
+	offset, err := c.QueryInt64("offset")
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	limit, err := c.QueryInt64("limit")
+	if err != nil || limit <= 0 {
+		limit = defaultAPIPageSize
+	}
+	limit = min(limit, maxAPIPageSize)
+
+	entities, err := relays.GetSavedEntities()
+	if err != nil {
+		apiError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	feeds := make([]apiFeed, 0, limit)
+	for i := offset; i < int64(len(entities)) && i < offset+limit; i++ {
+		feeds = append(feeds, newAPIFeed(entities[i]))
+	}
+
+	c.JSON(http.StatusOK, map[string]any{
+		"feeds":  feeds,
+		"total":  len(entities),
+		"offset": offset,
+		"limit":  limit,
+	})
+}
+
+func (s *Server) apiCreateFeed(c *router.Context) {
+	metrics.CreateRequestsAPI.Inc()
+
+	var req struct {
+		URL          string            `json:"url"`
+		NoteTemplate string            `json:"note_template"`
+		OutputMode   models.OutputMode `json:"output_mode"`
+	}
+	if err := json.NewDecoder(io.LimitReader(c.Req.Body, 1<<20)).Decode(&req); err != nil {
+		apiError(c, http.StatusBadRequest, "invalid json body")
+		return
+	}
+	if !helpers.IsValidHttpUrl(req.URL) {
+		apiError(c, http.StatusBadRequest, fmt.Sprintf("invalid url %q", req.URL))
+		return
+	}
+
+	entry := s.createFeed(req.URL, req.NoteTemplate, req.OutputMode, &s.Cfg.RandomSecret)
+	if entry.Error {
+		apiError(c, entry.ErrorCode, entry.ErrorMessage)
+		return
+	}
+
+	queueFollowAction(models.FollowManagment{
+		Action: models.Sync,
+	})
+
+	entity, err := relays.GetSavedEntity(entry.BookmarkEntity.PubKey)
+	if err != nil || entity.PubKey == "" {
+		apiError(c, http.StatusInternalServerError, "feed was not saved")
+		return
+	}
+	c.JSON(http.StatusCreated, newAPIFeed(entity))
+}
+
+// handleAPIFeed returns a feed on GET and deletes it on DELETE.
+func (s *Server) handleAPIFeed(c *router.Context) {
+	if !apiMethods(c, http.MethodGet, http.MethodDelete) {
+		return
+	}
+
+	pubkey := apiPubkey(c)
+	entity, err := relays.GetSavedEntity(pubkey)
+	if err != nil {
+		apiError(c, http.StatusInternalServerError, err.Error())
+		return
+	} else if entity.PubKey == "" {
+		apiError(c, http.StatusNotFound, "feed not found")
+		return
+	}
+
+	if c.Req.Method == http.MethodGet {
+		c.JSON(http.StatusOK, newAPIFeed(entity))
+		return
+	}
+
+	metrics.DeleteRequests.Inc()
+	localOnly := c.Req.URL.Query().Get("local_only") == "true"
+	if err := relays.DeleteEntity(pubkey, localOnly); err != nil {
+		log.Printf("[ERROR] could not delete feed '%q'...Error: %s ", pubkey, err)
+		apiError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// the follow list is rebuilt from the remaining feeds
+	queueFollowAction(models.FollowManagment{
+		Action: models.Sync,
+	})
+	c.Out.WriteHeader(http.StatusNoContent)
+}
+
+// handleAPIRefreshFeed queues a feed for an immediate check.
+func handleAPIRefreshFeed(c *router.Context) {
+	if !apiMethods(c, http.MethodPost) {
+		return
+	}
+
+	err := relays.CheckFeedNow(apiPubkey(c))
+	switch {
+	case errors.Is(err, relays.ErrEntityNotFound):
+		apiError(c, http.StatusNotFound, "feed not found")
+	case errors.Is(err, relays.ErrSchedulerStopped):
+		apiError(c, http.StatusServiceUnavailable, err.Error())
+	case err != nil:
+		apiError(c, http.StatusInternalServerError, err.Error())
+	default:
+		c.JSON(http.StatusAccepted, map[string]string{"status": "queued"})
+	}
+}
+
+// handleAPIFeedCategories replaces the categories of a feed, and with them
+// its follow sets.
+func handleAPIFeedCategories(c *router.Context) {
+	if !apiMethods(c, http.MethodPut) {
+		return
+	}
+
+	var req struct {
+		Categories []string `json:"categories"`
+	}
+	if err := json.NewDecoder(io.LimitReader(c.Req.Body, 1<<20)).Decode(&req); err != nil {
+		apiError(c, http.StatusBadRequest, "invalid json body")
+		return
+	}
+
+	pubkey := apiPubkey(c)
+	err := relays.SetFeedCategories(pubkey, req.Categories)
+	if errors.Is(err, relays.ErrEntityNotFound) {
+		apiError(c, http.StatusNotFound, "feed not found")
+		return
+	} else if err != nil {
+		apiError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	queueFollowAction(models.FollowManagment{
+		Action: models.Sync,
+	})
+
+	entity, err := relays.GetSavedEntity(pubkey)
+	if err != nil {
+		apiError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, newAPIFeed(entity))
+}
+
+// handleAPIImport adds the feeds of an import file in the background, see
+// parseImportFile for the formats. The file is either the request body or
+// the opml-file field of a form.
+func (s *Server) handleAPIImport(c *router.Context) {
+	if !apiMethods(c, http.MethodPost) {
+		return
+	}
+	metrics.ImportRequests.Inc()
+
+	if shuttingDown() {
+		apiError(c, http.StatusServiceUnavailable, "server shutting down")
+		return
+	}
+
+	var body io.Reader = c.Req.Body
+	if strings.HasPrefix(c.Req.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := c.Req.FormFile("opml-file")
+		if err != nil {
+			apiError(c, http.StatusBadRequest, "missing opml-file")
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+
+	fileBytes, err := io.ReadAll(io.LimitReader(body, 10<<20))
+	if err != nil {
+		apiError(c, http.StatusBadRequest, "unreadable import file")
+		return
+	}
+	format, feeds, err := parseImportFile(fileBytes)
+	if err != nil {
+		apiError(c, http.StatusBadRequest, fmt.Sprintf("bad import file: %s", err))
+		return
+	}
+
+	backgroundJobs.Add(1)
+	go func() {
+		defer backgroundJobs.Done()
+		setRecentImport(s.importFeeds(feeds, &s.Cfg.RandomSecret, func(int, int) {}), format)
+	}()
+
+	log.Printf("[DEBUG] api %s import of %d feeds started.", format, len(feeds))
+	c.JSON(http.StatusAccepted, map[string]any{"feeds": len(feeds), "format": format})
+}
+
+// handleAPIExport exports all feeds as OPML, or as JSON with format=json.
+func (s *Server) handleAPIExport(c *router.Context) {
+	if !apiMethods(c, http.MethodGet) {
+		return
+	}
+
+	switch format := c.Req.URL.Query().Get("format"); format {
+	case "", "opml":
+		outp, err := exportOpml()
+		if err != nil {
+			apiError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.Out.Header().Set("Content-Type", "application/opml")
+		c.Out.Header().Set("Content-Disposition", "attachment; filename="+time.Now().Format(time.DateOnly)+"-rssnotes.opml")
+		fmt.Fprintf(c.Out, "%s", outp)
+	case "json":
+		entities, err := relays.GetSavedEntities()
+		if err != nil {
+			apiError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		feeds := make([]apiFeed, 0, len(entities))
+		for _, entity := range entities {
+			feeds = append(feeds, newAPIFeed(entity))
+		}
+		c.JSON(http.StatusOK, map[string]any{"feeds": feeds})
+	default:
+		apiError(c, http.StatusBadRequest, fmt.Sprintf("unknown format %q", format))
+	}
+}
+
+// handleAPIRelays lists the seed relays on GET, adds one or changes its
+// roles on POST and removes the one named by the url parameter on DELETE.
+func handleAPIRelays(c *router.Context) {
+	if !apiMethods(c, http.MethodGet, http.MethodPost, http.MethodDelete) {
+		return
+	}
+
+	switch c.Req.Method {
+	case http.MethodGet:
+		seedRelays := relays.GetSeedRelays()
+		list := make([]apiSeedRelay, 0, len(seedRelays))
+		for _, relay := range seedRelays {
+			list = append(list, newAPISeedRelay(relay))
+		}
+		c.JSON(http.StatusOK, map[string]any{"relays": list})
+
+	case http.MethodPost:
+		var req struct {
+			URL   string `json:"url"`
+			Read  bool   `json:"read"`
+			Write bool   `json:"write"`
+		}
+		if err := json.NewDecoder(io.LimitReader(c.Req.Body, 1<<20)).Decode(&req); err != nil {
+			apiError(c, http.StatusBadRequest, "invalid json body")
+			return
+		}
+		relay, err := relays.SaveSeedRelay(req.URL, req.Read, req.Write)
+		if errors.Is(err, relays.ErrSeedRelayNoRole) || errors.Is(err, helpers.ErrInvalidRelayURL) {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		} else if err != nil {
+			apiError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, newAPISeedRelay(relay))
+
+	case http.MethodDelete:
+		err := relays.DeleteSeedRelay(c.Req.URL.Query().Get("url"))
+		switch {
+		case errors.Is(err, relays.ErrSeedRelayNotFound):
+			apiError(c, http.StatusNotFound, err.Error())
+		case errors.Is(err, helpers.ErrInvalidRelayURL):
+			apiError(c, http.StatusBadRequest, err.Error())
+		case err != nil:
+			apiError(c, http.StatusInternalServerError, err.Error())
+		default:
+			c.Out.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// handleAPIStats reports feed counts and the relay metrics.
+func (s *Server) handleAPIStats(c *router.Context) {
+	if !apiMethods(c, http.MethodGet) {
+		return
+	}
+
+	entities, err := relays.GetSavedEntities()
+	if err != nil {
+		apiError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	failing := 0
+	for _, entity := range entities {
+		if entity.ConsecutiveFailures > 0 {
+			failing++
+		}
+	}
+
+	values := metricValues()
+	c.JSON(http.StatusOK, map[string]any{
+		"version":               config.Version,
+		"feeds":                 len(entities),
+		"failing_feeds":         failing,
+		"notes_created":         values["rssnotes_processed_kind_one_notes_created_total"],
+		"notes_deleted":         values["rssnotes_processed_kind_one_notes_deleted_total"],
+		"articles_created":      values["rssnotes_processed_kind_long_form_created_total"],
+		"notes_blasted":         values["rssnotes_processed_notes_blasted_total"],
+		"outbox_length":         values["rssnotes_replay_routines_queue_length"],
+		"events_replicated":     values["rssnotes_replay_events_total"],
+		"replication_errors":    values["rssnotes_replay_events_error_total"],
+		"query_requests":        values["rssnotes_processed_query_events_ops_total"],
+		"feed_checks_failed":    values["rssnotes_processed_feeds_failed_total"],
+		"feeds_retired":         values["rssnotes_processed_feeds_retired_total"],
+		"scheduler_queue_depth": values["rssnotes_scheduler_queue_depth"],
+		"scheduler_lag_seconds": values["rssnotes_scheduler_lag_seconds"],
+	})
+}
+
+// metricValues reads the current counter and gauge values by metric name,
+// summed over labels.
+func metricValues() map[string]float64 {
+	values := make(map[string]float64)
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		log.Printf("[ERROR] gathering metrics: %s", err)
+	}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			values[family.GetName()] += metric.GetCounter().GetValue() + metric.GetGauge().GetValue()
+		}
+	}
+	return values
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"rssnotes/server/router"
+	"slices"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+const KIND_HTTP_AUTH int = 27235 //NIP-98
+
+// managementPaths change feeds or expose private data. Everything else is
+// public.
+var managementPaths = []string{"/create", "/delete", "/import", "/export", "/log", "/template", "/output", "/replication", "/hashtags", "/categories", "/nip05", "/seedrelays", "/seedrelays/delete"}
+
+// mutatingPaths are the management paths that change feeds. They only
+// accept POST.
+var mutatingPaths = []string{"/create", "/delete", "/import", "/template", "/output", "/replication", "/hashtags", "/categories", "/nip05", "/seedrelays", "/seedrelays/delete"}
+
+// managerPubkeys returns the owner and admin pubkeys in hex. Keys may be
+// configured as hex or npub.
+func managerPubkeys(ownerPubkey string, adminPubkeys []string) map[string]bool {
+	managers := make(map[string]bool)
+	for _, key := range append([]string{ownerPubkey}, adminPubkeys...) {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		if strings.HasPrefix(key, "npub") {
+			if _, value, err := nip19.Decode(key); err == nil {
+				key = value.(string)
+			}
+		}
+		if !nostr.IsValidPublicKey(key) {
+			log.Printf("[ERROR] ignoring invalid owner or admin pubkey %q", key)
+			continue
+		}
+		managers[key] = true
+	}
+	return managers
+}
+
+// requireManager lets management requests through only for the owner or an
+// admin, authenticated either by a NIP-98 Authorization header or by a
+// browser session. Browser requests that change feeds also need the CSRF
+// token of the session. Without any configured owner or admin nobody can
+// manage the relay. In the API everything but reading feeds and stats is
+// management.
+func (s *Server) requireManager(c *router.Context) {
+	path := strings.TrimPrefix(c.Req.URL.Path, s.Cfg.RelayBasepath)
+
+	var managed, mutating bool
+	api := strings.HasPrefix(path, apiPrefix+"/")
+	if api {
+		mutating = c.Req.Method != http.MethodGet && c.Req.Method != http.MethodHead
+		managed = mutating || path == apiPrefix+"/export"
+	} else {
+		managed = slices.Contains(managementPaths, path)
+		mutating = slices.Contains(mutatingPaths, path)
+	}
+	if !managed {
+		c.Next()
+		return
+	}
+
+	fail := func(status int, message string) {
+		if status == http.StatusUnauthorized {
+			c.Out.Header().Set("WWW-Authenticate", "Nostr")
+		}
+		if api {
+			apiError(c, status, message)
+		} else {
+			http.Error(c.Out, message, status)
+		}
+	}
+
+	if mutating && !api && c.Req.Method != http.MethodPost {
+		c.Out.Header().Set("Allow", http.MethodPost)
+		fail(http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if len(s.managers) == 0 {
+		log.Printf("[INFO] rejected %s %s: no owner configured", c.Req.Method, c.Req.URL.Path)
+		fail(http.StatusForbidden, "no owner configured, set OWNER_PUBKEY")
+		return
+	}
+
+	var pubkey string
+	if c.Req.Header.Get("Authorization") != "" {
+		var err error
+		if pubkey, err = s.checkHTTPAuth(c.Req); err != nil {
+			log.Printf("[INFO] rejected %s %s: %s", c.Req.Method, c.Req.URL.Path, err)
+			fail(http.StatusUnauthorized, err.Error())
+			return
+		}
+	} else if _, sess, ok := s.sessionOf(c.Req); ok {
+		if mutating && !validCSRF(c.Req, sess) {
+			log.Printf("[INFO] rejected %s %s: invalid csrf token", c.Req.Method, c.Req.URL.Path)
+			fail(http.StatusForbidden, "invalid csrf token")
+			return
+		}
+		pubkey = sess.pubkey
+	} else {
+		fail(http.StatusUnauthorized, "login required")
+		return
+	}
+
+	if !s.managers[pubkey] {
+		log.Printf("[INFO] rejected %s %s from %s", c.Req.Method, c.Req.URL.Path, pubkey)
+		fail(http.StatusForbidden, "not allowed to manage this relay")
+		return
+	}
+
+	c.Next()
+}
+
+// checkHTTPAuth verifies the NIP-98 event of a request and returns its
+// pubkey.
+func (s *Server) checkHTTPAuth(req *http.Request) (string, error) {
+	scheme, encoded, found := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Nostr") {
+		return "", errors.New("missing nostr authorization")
+	}
+
+	eventJSON, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", errors.New("invalid base64 authorization")
+	}
+	var evt nostr.Event
+	if err := json.Unmarshal(eventJSON, &evt); err != nil {
+		return "", errors.New("invalid authorization event json")
+	}
+
+	if err := s.verifyHTTPAuthEvent(evt, req); err != nil {
+		return "", err
+	}
+
+	if tag := evt.Tags.GetFirst([]string{"payload", ""}); tag != nil {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return "", errors.New("unreadable request body")
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.Sum256(body)
+		if !strings.EqualFold((*tag)[1], hex.EncodeToString(hash[:])) {
+			return "", errors.New("invalid 'payload' tag")
+		}
+	}
+
+	return evt.PubKey, nil
+}
+
+// verifyHTTPAuthEvent checks the kind, signature, age, method and url of a
+// NIP-98 event.
+func (s *Server) verifyHTTPAuthEvent(evt nostr.Event, req *http.Request) error {
+	if evt.Kind != KIND_HTTP_AUTH {
+		return fmt.Errorf("authorization event has kind %d", evt.Kind)
+	}
+	if ok, _ := evt.CheckSignature(); !ok {
+		return errors.New("invalid authorization event signature")
+	}
+
+	age := nostr.Now() - evt.CreatedAt
+	if age > nostr.Timestamp(s.Cfg.AuthMaxAgeSecs) || -age > nostr.Timestamp(s.Cfg.AuthMaxAgeSecs) {
+		return errors.New("authorization event is too old or in the future")
+	}
+
+	if tag := evt.Tags.GetFirst([]string{"method", ""}); tag == nil || !strings.EqualFold((*tag)[1], req.Method) {
+		return errors.New("invalid 'method' tag")
+	}
+	if tag := evt.Tags.GetFirst([]string{"u", ""}); tag == nil || !s.isRequestURL((*tag)[1], req) {
+		return errors.New("invalid 'u' tag")
+	}
+	return nil
+}
+
+// isRequestURL reports whether the u tag of an auth event names the request,
+// either through the public relay url or the host the request was sent to.
+// The scheme is not compared since TLS usually ends at a proxy.
+func (s *Server) isRequestURL(tagURL string, req *http.Request) bool {
+	u, err := url.Parse(tagURL)
+	if err != nil || u.RequestURI() != req.URL.RequestURI() {
+		return false
+	}
+	return strings.EqualFold(u.Host, s.GetAddr().Host) || strings.EqualFold(u.Host, req.Host)
+}
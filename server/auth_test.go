@@ -0,0 +1,43 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"rssnotes/internal/config"
+	"rssnotes/server/router"
+	"testing"
+)
+
+func TestRequireManagerWithoutOwner(t *testing.T) {
+	s := &Server{
+		Cfg:      &config.C{},
+		managers: managerPubkeys("", nil),
+		sessions: newSessionStore(),
+	}
+
+	r := router.NewRouter("")
+	r.Use(s.requireManager)
+	ok := func(c *router.Context) { c.Out.WriteHeader(http.StatusOK) }
+	r.For("/home", ok)
+	r.For("/create", ok)
+	r.For("/export", ok)
+	r.For(apiPrefix+"/feeds", ok)
+
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/home", http.StatusOK},
+		{http.MethodGet, apiPrefix + "/feeds", http.StatusOK},
+		{http.MethodPost, "/create", http.StatusForbidden},
+		{http.MethodGet, "/export", http.StatusForbidden},
+		{http.MethodPost, apiPrefix + "/feeds", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+		if rec.Code != tt.want {
+			t.Errorf("%s %s: got %d, want %d", tt.method, tt.path, rec.Code, tt.want)
+		}
+	}
+}
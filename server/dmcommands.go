@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"rssnotes/internal/helpers"
+	"rssnotes/internal/models"
+	"rssnotes/internal/relays"
+	"rssnotes/metrics"
+	"strings"
+	"time"
+)
+
+// maxListedFeeds keeps the reply to "list" a readable size.
+const maxListedFeeds = 100
+
+const dmHelp = `Commands:
+add <url> - follow a feed
+remove <npub|url> [local] - delete a feed and its notes, "local" skips the deletion requests to other relays
+list - show all feeds
+status <npub|url> - show the health of a feed
+pause <npub|url> - stop checking a feed
+resume <npub|url> - check a paused feed again
+help - show this message`
+
+// startDMCommands answers direct messages from the owner and admins until
+// shutdown.
+func (s *Server) startDMCommands() {
+	senders := make([]string, 0, len(s.managers))
+	for pubkey := range s.managers {
+		senders = append(senders, pubkey)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-quitChannel
+		cancel()
+	}()
+
+	backgroundJobs.Add(1)
+	go func() {
+		defer backgroundJobs.Done()
+		relays.ListenForDirectMessages(ctx, senders, func(msg relays.DirectMessage) {
+			reply := s.runDMCommand(msg.Content)
+			if err := relays.ReplyDirectMessage(msg, reply); err != nil {
+				log.Printf("[ERROR] replying to direct message from %s: %s", msg.Sender, err)
+			}
+		})
+	}()
+}
+
+// runDMCommand executes one command line and returns the reply text.
+func (s *Server) runDMCommand(content string) string {
+	command, arg, _ := strings.Cut(strings.TrimSpace(content), " ")
+	command = strings.ToLower(command)
+	arg = strings.TrimSpace(arg)
+
+	log.Printf("[INFO] direct message command %q %q", command, arg)
+
+	switch command {
+	case "add":
+		return s.dmAddFeed(arg)
+	case "remove", "delete":
+		feed, local, _ := strings.Cut(arg, " ")
+		return dmRemoveFeed(feed, strings.TrimSpace(local) == "local")
+	case "list":
+		return dmListFeeds()
+	case "status":
+		return dmFeedStatus(arg)
+	case "pause":
+		return dmPauseFeed(arg, true)
+	case "resume":
+		return dmPauseFeed(arg, false)
+	case "help", "":
+		return dmHelp
+	default:
+		return fmt.Sprintf("Unknown command %q.\n\n%s", command, dmHelp)
+	}
+}
+
+func (s *Server) dmAddFeed(arg string) string {
+	metrics.CreateRequests.Inc()
+
+	if !helpers.IsValidHttpUrl(arg) {
+		return fmt.Sprintf("Invalid url %q.", arg)
+	}
+
+	entry := s.createFeed(arg, "", models.OutputNotes, &s.Cfg.RandomSecret)
+	if entry.Error {
+		return entry.ErrorMessage
+	}
+
+	queueFollowAction(models.FollowManagment{
+		Action: models.Sync,
+	})
+	return fmt.Sprintf("Added %s\nnostr:%s", entry.BookmarkEntity.URL, entry.NProfile)
+}
+
+func dmRemoveFeed(arg string, localOnly bool) string {
+	entity, reply := dmFindFeed(arg)
+	if entity.PubKey == "" {
+		return reply
+	}
+
+	metrics.DeleteRequests.Inc()
+	if err := relays.DeleteEntity(entity.PubKey, localOnly); err != nil {
+		log.Printf("[ERROR] could not delete feed '%q'...Error: %s ", entity.PubKey, err)
+		return fmt.Sprintf("Could not delete %s: %s", entity.URL, err)
+	}
+
+	queueFollowAction(models.FollowManagment{
+		Action: models.Sync,
+	})
+	return fmt.Sprintf("Removed %s", entity.URL)
+}
+
+func dmListFeeds() string {
+	entities, err := relays.GetSavedEntities()
+	if err != nil {
+		return fmt.Sprintf("Could not list feeds: %s", err)
+	}
+	if len(entities) == 0 {
+		return "No feeds yet."
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d feeds:\n", len(entities))
+	for i, entity := range entities {
+		if i == maxListedFeeds {
+			fmt.Fprintf(&b, "... and %d more", len(entities)-maxListedFeeds)
+			break
+		}
+		b.WriteString(entity.URL)
+		if entity.Paused {
+			b.WriteString(" (paused)")
+		} else if entity.ConsecutiveFailures > 0 {
+			fmt.Fprintf(&b, " (%d× failed)", entity.ConsecutiveFailures)
+		}
+		b.WriteString("\n")
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func dmFeedStatus(arg string) string {
+	entity, reply := dmFindFeed(arg)
+	if entity.PubKey == "" {
+		return reply
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\nnostr:%s\n", entity.URL, relays.NProfile(entity.PubKey))
+	switch {
+	case entity.ConsecutiveFailures > 0:
+		fmt.Fprintf(&b, "failing: %d× %s error: %s\n", entity.ConsecutiveFailures, entity.LastErrorClass, entity.LastError)
+	case entity.LastSuccessTime > 0:
+		b.WriteString("healthy\n")
+	default:
+		b.WriteString("not checked yet\n")
+	}
+	fmt.Fprintf(&b, "last post: %s\n", dmTime(entity.LastPostTime))
+	fmt.Fprintf(&b, "last check: %s\n", dmTime(entity.LastCheckedTime))
+	if entity.Paused {
+		b.WriteString("paused, send \"resume\" to check it again")
+	} else {
+		fmt.Fprintf(&b, "next check: %s", dmTime(helpers.NextFeedUpdate(entity)))
+	}
+	return b.String()
+}
+
+func dmPauseFeed(arg string, paused bool) string {
+	entity, reply := dmFindFeed(arg)
+	if entity.PubKey == "" {
+		return reply
+	}
+
+	if err := relays.SetFeedPaused(entity.PubKey, paused); err != nil {
+		log.Printf("[ERROR] could not pause feed %s: %s", entity.PubKey, err)
+		return fmt.Sprintf("Could not update %s: %s", entity.URL, err)
+	}
+	if paused {
+		return fmt.Sprintf("Paused %s", entity.URL)
+	}
+	return fmt.Sprintf("Resumed %s", entity.URL)
+}
+
+// dmFindFeed looks a feed up by npub, nprofile, hex pubkey or feed url. When there is
+// none, the entity is empty and the reply says why.
+func dmFindFeed(arg string) (models.Entity, string) {
+	if arg == "" {
+		return models.Entity{}, "Which feed? Send an npub or the feed url."
+	}
+
+	var entity models.Entity
+	var err error
+	if pubkey := relays.DecodePubkey(arg); pubkey != "" {
+		entity, err = relays.GetSavedEntity(pubkey)
+	} else {
+		entity, err = relays.GetSavedEntityByURL(arg)
+	}
+
+	if err != nil {
+		return models.Entity{}, fmt.Sprintf("Could not look up %s: %s", arg, err)
+	} else if entity.PubKey == "" {
+		return models.Entity{}, fmt.Sprintf("No feed %s, send \"list\" to see the feed urls.", arg)
+	}
+	return entity, ""
+}
+
+func dmTime(unix int64) string {
+	if unix == 0 {
+		return "never"
+	}
+	return time.Unix(unix, 0).UTC().Format("2006-01-02 15:04 MST")
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"rssnotes/internal/models"
+	"rssnotes/internal/relays"
+	"strings"
+)
+
+// Import file formats, as shown on the import results.
+const (
+	importOPML = "OPML"
+	importJSON = "JSON"
+	importText = "URL list"
+)
+
+// maxImportLine is the longest line of a URL list, feed urls with long
+// query strings included.
+const maxImportLine = 1 << 20
+
+var errUnknownImportFormat = errors.New("not an OPML, JSON or URL list file")
+
+// parseImportFile tells the format of an import file by its content and
+// returns its feeds. OPML is what most readers export, JSON covers Feedly,
+// Inoreader, Miniflux and the rssnotes and rsslay exports, and a URL list
+// is a newsboat urls file or any file with one feed url per line.
+func parseImportFile(b []byte) (string, []importedFeed, error) {
+	b = bytes.TrimSpace(bytes.TrimPrefix(b, []byte("\xef\xbb\xbf")))
+	if len(b) == 0 {
+		return "", nil, errors.New("empty file")
+	}
+
+	switch b[0] {
+	case '<':
+		doc, err := models.NewOPML(b)
+		if err != nil {
+			return importOPML, nil, err
+		}
+		return importOPML, uniqueFeeds(opmlFeeds(doc.Body.Outlines)), nil
+	case '{', '[':
+		feeds, err := jsonFeeds(b)
+		return importJSON, uniqueFeeds(feeds), err
+	}
+
+	if !bytes.Contains(b, []byte("://")) {
+		return "", nil, errUnknownImportFormat
+	}
+	feeds, err := textFeeds(b)
+	return importText, uniqueFeeds(feeds), err
+}
+
+// jsonFeed has the fields of the feeds of every supported JSON export.
+// Feedly and Inoreader put the feed url into the id as "feed/<url>",
+// Miniflux has feed_url and a category object, rssnotes and rsslay a url.
+type jsonFeed struct {
+	ID         json.RawMessage `json:"id"`
+	URL        string          `json:"url"`
+	FeedURL    string          `json:"feed_url"`
+	XMLURL     string          `json:"xmlUrl"`
+	Title      string          `json:"title"`
+	Website    string          `json:"website"`
+	HTMLURL    string          `json:"htmlUrl"`
+	SiteURL    string          `json:"site_url"`
+	Categories json.RawMessage `json:"categories"`
+	Category   json.RawMessage `json:"category"`
+	NIP05      string          `json:"nip05"`
+}
+
+func jsonFeeds(b []byte) ([]importedFeed, error) {
+	var list []jsonFeed
+	if err := json.Unmarshal(b, &list); err != nil {
+		var doc struct {
+			Subscriptions []jsonFeed `json:"subscriptions"` // Inoreader
+			Feeds         []jsonFeed `json:"feeds"`         // rssnotes
+		}
+		if err := json.Unmarshal(b, &doc); err != nil {
+			return nil, err
+		}
+		list = append(doc.Subscriptions, doc.Feeds...)
+	}
+	if len(list) == 0 {
+		return nil, errors.New("no feeds in the JSON file")
+	}
+
+	feeds := make([]importedFeed, 0, len(list))
+	for _, entry := range list {
+		var id string
+		_ = json.Unmarshal(entry.ID, &id) // Miniflux ids are numbers
+
+		feed := importedFeed{
+			URL:        strings.TrimSpace(cmp.Or(entry.FeedURL, entry.XMLURL, strings.TrimPrefix(id, "feed/"), entry.URL)),
+			Title:      strings.TrimSpace(entry.Title),
+			SiteURL:    strings.TrimSpace(cmp.Or(entry.SiteURL, entry.HTMLURL, entry.Website)),
+			Categories: relays.MergeCategories(nil, jsonCategories(entry.Categories)...),
+		}
+		feed.Categories = relays.MergeCategories(feed.Categories, jsonCategory(entry.Category))
+		feed.NIP05Name, _, _ = strings.Cut(entry.NIP05, "@")
+		feeds = append(feeds, feed)
+	}
+	return feeds, nil
+}
+
+// jsonCategories reads a list of category names, or of Feedly and
+// Inoreader category objects, leaving out the Feedly system categories.
+func jsonCategories(raw json.RawMessage) []string {
+	var names []string
+	if json.Unmarshal(raw, &names) == nil {
+		return names
+	}
+
+	var labelled []struct {
+		ID    string `json:"id"`
+		Label string `json:"label"`
+	}
+	if json.Unmarshal(raw, &labelled) != nil {
+		return nil
+	}
+	for _, category := range labelled {
+		if !strings.Contains(category.ID, "/category/global.") {
+			names = append(names, category.Label)
+		}
+	}
+	return names
+}
+
+// jsonCategory reads a category name, or the title of a Miniflux category.
+func jsonCategory(raw json.RawMessage) string {
+	var name string
+	if json.Unmarshal(raw, &name) == nil {
+		return name
+	}
+
+	var category struct {
+		Title string `json:"title"`
+	}
+	_ = json.Unmarshal(raw, &category)
+	return category.Title
+}
+
+// textFeeds reads one feed per line, in the newsboat urls format: the url,
+// then tags that become categories. A "~" tag is the title and quotes hold
+// tags with spaces. Comments and newsboat query, exec and filter feeds are
+// left out.
+func textFeeds(b []byte) ([]importedFeed, error) {
+	feeds := make([]importedFeed, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(nil, maxImportLine)
+	for scanner.Scan() {
+		fields := splitQuoted(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		feed := importedFeed{URL: fields[0]}
+		if scheme, _, ok := strings.Cut(fields[0], ":"); ok && (scheme == "query" || scheme == "exec" || scheme == "filter") {
+			feed.Skip = fmt.Sprintf("newsboat %s feeds can not be imported", scheme)
+		}
+		for _, tag := range fields[1:] {
+			switch {
+			case strings.HasPrefix(tag, "~"):
+				feed.Title = strings.TrimPrefix(tag, "~")
+			case strings.HasPrefix(tag, "!"):
+				// hidden in newsboat
+			default:
+				feed.Categories = relays.MergeCategories(feed.Categories, tag)
+			}
+		}
+		feeds = append(feeds, feed)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return feeds, nil
+}
+
+// splitQuoted splits a line at spaces outside of double quotes. A backslash
+// escapes the next character.
+func splitQuoted(line string) []string {
+	fields := make([]string, 0)
+	var field strings.Builder
+	quoted, inField, escaped := false, false, false
+	for _, r := range strings.TrimSpace(line) {
+		switch {
+		case escaped:
+			field.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+			inField = true
+		case r == '"':
+			quoted = !quoted
+			inField = true
+		case (r == ' ' || r == '\t') && !quoted:
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+// uniqueFeeds merges the entries of the same feed url, keeping the first
+// title and all categories.
+func uniqueFeeds(feeds []importedFeed) []importedFeed {
+	unique := make([]importedFeed, 0, len(feeds))
+	seen := make(map[string]int)
+	for _, feed := range feeds {
+		if i, ok := seen[feed.URL]; ok && feed.URL != "" {
+			unique[i].Categories = relays.MergeCategories(unique[i].Categories, feed.Categories...)
+			continue
+		}
+		seen[feed.URL] = len(unique)
+		unique = append(unique, feed)
+	}
+	return unique
+}
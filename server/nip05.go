@@ -0,0 +1,87 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"rssnotes/internal/relays"
+	"rssnotes/metrics"
+	"rssnotes/server/router"
+	"strings"
+)
+
+// nostrJSON is the NIP-05 well-known document.
+type nostrJSON struct {
+	Names  map[string]string   `json:"names"`
+	Relays map[string][]string `json:"relays"`
+}
+
+// handleNostrJSON answers NIP-05 lookups for the feeds and for the relay
+// itself as "_". Without a name it lists every feed.
+func (s *Server) handleNostrJSON(c *router.Context) {
+	metrics.WellKnownRequests.Inc()
+	c.Out.Header().Set("Access-Control-Allow-Origin", "*")
+
+	doc := nostrJSON{
+		Names:  make(map[string]string),
+		Relays: make(map[string][]string),
+	}
+	relayURLs := []string{relays.PublicRelayURL()}
+
+	if name := strings.ToLower(c.Req.URL.Query().Get("name")); name != "" {
+		pubkey, err := relays.LookupNIP05Name(name)
+		if err != nil {
+			log.Printf("[ERROR] nip05 lookup of %q: %s", name, err)
+			http.Error(c.Out, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if pubkey != "" {
+			doc.Names[name] = pubkey
+			doc.Relays[pubkey] = relayURLs
+		}
+		c.JSON(http.StatusOK, doc)
+		return
+	}
+
+	entities, err := relays.GetSavedEntities()
+	if err != nil {
+		log.Printf("[ERROR] nip05 names: %s", err)
+		http.Error(c.Out, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	doc.Names[relays.NIP05RelayName] = s.Cfg.RelayPubkey
+	doc.Relays[s.Cfg.RelayPubkey] = relayURLs
+	for _, entity := range entities {
+		if entity.NIP05Name != "" {
+			doc.Names[entity.NIP05Name] = entity.PubKey
+			doc.Relays[entity.PubKey] = relayURLs
+		}
+	}
+	c.JSON(http.StatusOK, doc)
+}
+
+// handleNIP05Name overrides the nip05 name of a feed. An empty name goes
+// back to the one derived from the feed url.
+func handleNIP05Name(c *router.Context) {
+	feedPubkey := c.Req.FormValue("pubkey")
+
+	err := relays.SetNIP05Name(feedPubkey, c.Req.FormValue("name"))
+	switch {
+	case errors.Is(err, relays.ErrEntityNotFound):
+		http.Error(c.Out, "feed not found", http.StatusNotFound)
+		return
+	case errors.Is(err, relays.ErrInvalidNIP05Name):
+		http.Error(c.Out, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, relays.ErrNIP05NameTaken):
+		http.Error(c.Out, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		log.Printf("[ERROR] could not set nip05 name of %s: %s", feedPubkey, err)
+		http.Error(c.Out, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[DEBUG] nip05 name of %s updated", feedPubkey)
+	c.Out.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"rssnotes/internal/models"
+	"rssnotes/internal/relays"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// importedFeed is one feed of an import file, whatever its format, see
+// parseImportFile.
+type importedFeed struct {
+	URL        string
+	Title      string
+	SiteURL    string
+	Categories []string
+	NIP05Name  string
+	Skip       string // why the feed can not be imported, if so
+}
+
+// opmlFeeds walks the outlines recursively and returns their feeds. The
+// folders above a feed and its category attribute become its categories.
+func opmlFeeds(outlines []models.OpmlOutline) []importedFeed {
+	feeds := make([]importedFeed, 0)
+
+	var walk func(outlines []models.OpmlOutline, folder []string)
+	walk = func(outlines []models.OpmlOutline, folder []string) {
+		for _, outline := range outlines {
+			feedUrl := strings.TrimSpace(outline.XMLURL)
+			if feedUrl == "" {
+				// a folder, or some other outline without a feed
+				walk(outline.Outlines, append(folder[:len(folder):len(folder)], outlineTitle(outline)))
+				continue
+			}
+
+			categories := relays.MergeCategories(nil, strings.Join(folder, "/"))
+			categories = relays.MergeCategories(categories, strings.Split(outline.Category, ",")...)
+
+			nip05Name, _, _ := strings.Cut(outline.NIP05, "@")
+			feeds = append(feeds, importedFeed{
+				URL:        feedUrl,
+				Title:      outlineTitle(outline),
+				SiteURL:    strings.TrimSpace(outline.HTMLURL),
+				Categories: categories,
+				NIP05Name:  nip05Name,
+			})
+		}
+	}
+	walk(outlines, nil)
+	return feeds
+}
+
+func outlineTitle(outline models.OpmlOutline) string {
+	if title := strings.TrimSpace(outline.Title); title != "" {
+		return title
+	}
+	return strings.TrimSpace(outline.Text)
+}
+
+// exportOpml writes every feed into the folder of its first category. The
+// category attribute lists all of them, and npub and nip05 identify the
+// feed on nostr.
+func exportOpml() (string, error) {
+	var rssOMPL = &models.OPML{
+		Version: "2.0",
+		Head: models.OpmlHead{
+			Title:       "rssnotes Feeds",
+			DateCreated: time.Now().Format(time.RFC1123Z),
+			OwnerName:   "rssnotes",
+		},
+	}
+
+	data, err := relays.GetSavedEntities()
+	if err != nil {
+		return "", err
+	}
+
+	for _, feed := range data {
+		title := feed.Title
+		if title == "" {
+			title = feed.URL
+		}
+		npub, _ := nip19.EncodePublicKey(feed.PubKey)
+
+		categories := make([]string, 0, len(feed.Categories))
+		for _, category := range feed.Categories {
+			categories = append(categories, "/"+category)
+		}
+
+		outline := models.OpmlOutline{
+			Type:     "rss",
+			Text:     title,
+			Title:    title,
+			XMLURL:   feed.URL,
+			HTMLURL:  feed.SiteURL,
+			Category: strings.Join(categories, ","),
+			NPub:     npub,
+			NIP05:    relays.NIP05Identifier(feed.NIP05Name),
+		}
+
+		var folder []string
+		if len(feed.Categories) > 0 {
+			folder = strings.Split(feed.Categories[0], "/")
+		}
+		addToOpmlFolder(&rssOMPL.Body.Outlines, folder, outline)
+	}
+
+	return rssOMPL.XML()
+}
+
+// addToOpmlFolder appends outline below the folder path, creating the
+// folders that do not exist yet.
+func addToOpmlFolder(outlines *[]models.OpmlOutline, folder []string, outline models.OpmlOutline) {
+	if len(folder) == 0 {
+		*outlines = append(*outlines, outline)
+		return
+	}
+
+	for i := range *outlines {
+		if (*outlines)[i].XMLURL == "" && (*outlines)[i].Text == folder[0] {
+			addToOpmlFolder(&(*outlines)[i].Outlines, folder[1:], outline)
+			return
+		}
+	}
+	*outlines = append(*outlines, models.OpmlOutline{Text: folder[0], Title: folder[0]})
+	addToOpmlFolder(&(*outlines)[len(*outlines)-1].Outlines, folder[1:], outline)
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"cmp"
 	"errors"
 	"fmt"
 	"io"
@@ -16,11 +17,12 @@ import (
 	"rssnotes/internal/yarr/yarrworker"
 	"rssnotes/metrics"
 	"rssnotes/server/router"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/gilliek/go-opml/opml"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip19"
 	"github.com/prometheus/client_golang/prometheus"
@@ -32,12 +34,30 @@ import (
 )
 
 var (
+	recentImportMu        sync.Mutex // guards the results of the last import
 	recentImportedEntries []*models.GUIEntry
+	recentImportFormat    string
 	importProgressCh      = make(chan models.ImportProgressStruct)
 )
 
+// setRecentImport keeps the results of an import for the details page.
+func setRecentImport(entries []*models.GUIEntry, format string) {
+	recentImportMu.Lock()
+	defer recentImportMu.Unlock()
+	recentImportedEntries = entries
+	recentImportFormat = format
+}
+
+// recentImport returns the results of the last import.
+func recentImport() ([]*models.GUIEntry, string) {
+	recentImportMu.Lock()
+	defer recentImportMu.Unlock()
+	return recentImportedEntries, recentImportFormat
+}
+
 func (s *Server) handler() http.Handler {
 	r := router.NewRouter(s.Cfg.RelayBasepath)
+	r.Use(s.requireManager)
 
 	r.For("/assets/*path", s.handleStatic)
 	r.For("/create", (func(c *router.Context) {
@@ -49,10 +69,22 @@ func (s *Server) handler() http.Handler {
 	r.For("/detail", s.handleImportDetail)
 	r.For("/export", s.handleExportOpml)
 	r.For("/delete", handleDeleteFeed)
+	r.For("/template", handleNoteTemplate)
+	r.For("/output", handleOutputMode)
+	r.For("/replication", handleReplication)
+	r.For("/hashtags", handleHashtags)
+	r.For("/categories", handleCategories)
+	r.For("/nip05", handleNIP05Name)
+	r.For("/seedrelays", s.handleSaveSeedRelay)
+	r.For("/seedrelays/delete", s.handleDeleteSeedRelay)
+	r.For("/.well-known/nostr.json", s.handleNostrJSON)
 	r.For("/metrics", func(c *router.Context) {
 		promhttp.Handler().ServeHTTP(c.Out, c.Req)
 	})
 	r.For("/metricsDisplay", s.handleMetricsDisplay)
+	s.apiRoutes(r)
+	r.For("/login", s.handleLogin)
+	r.For("/logout", s.handleLogout)
 	r.For("/log", s.handleLog)
 	r.For("/health", s.handleHealth)
 	r.For("/home", s.handleFrontpage)
@@ -63,6 +95,19 @@ func (s *Server) handler() http.Handler {
 	return r
 }
 
+// https://appliedgo.net/spotlight/functions-in-templates-funcmap/
+var templateFuncs = template.FuncMap{
+	"join": strings.Join,
+	"shortURL": func(urlLink string) string {
+		u, err := url.Parse(urlLink)
+		if err != nil {
+			log.Printf("[ERROR] shortURL: %s", err.Error())
+			return urlLink
+		}
+		return strings.TrimPrefix(u.Host, "www.")
+	},
+}
+
 func (s *Server) handleFrontpage(c *router.Context) {
 	metrics.IndexRequests.Inc()
 	items, err := relays.GetSavedEntries()
@@ -71,25 +116,14 @@ func (s *Server) handleFrontpage(c *router.Context) {
 		http.Error(c.Out, err.Error(), http.StatusInternalServerError)
 	}
 
-	//https://appliedgo.net/spotlight/functions-in-templates-funcmap/
-	funcs := template.FuncMap{
-		"shortURL": func(urlLink string) string {
-			u, err := url.Parse(urlLink)
-			if err != nil {
-				log.Printf("[ERROR] shortURL: %s", err.Error())
-				return urlLink
-			}
-			return strings.TrimPrefix(u.Host, "www.")
-		},
-	}
-
 	npub, _ := nip19.EncodePublicKey(s.Cfg.RelayPubkey)
-	tmpl := template.Must(template.New("index.html").Funcs(funcs).ParseFiles(fmt.Sprintf("%s/index.html", s.Cfg.TemplatePath)))
+	tmpl := template.Must(template.New("index.html").Funcs(templateFuncs).ParseFiles(fmt.Sprintf("%s/index.html", s.Cfg.TemplatePath)))
 
 	data := struct {
 		RelayName           string
 		RelayPubkey         string
 		RelayNPubkey        string
+		RelayNProfile       string
 		RelayDescription    string
 		RelayURL            string
 		Count               int
@@ -99,10 +133,15 @@ func (s *Server) handleFrontpage(c *router.Context) {
 		QueryEventsRequests string
 		NotesBlasted        string
 		Version             string
+		NoteStyles          map[string]string
+		OutputModes         []models.OutputMode
+		SeedRelays          []models.SeedRelay
+		Viewer              viewer
 	}{
 		RelayName:           s.Cfg.RelayName,
 		RelayPubkey:         s.Cfg.RelayPubkey,
 		RelayNPubkey:        npub,
+		RelayNProfile:       relays.NProfile(s.Cfg.RelayPubkey),
 		RelayDescription:    s.Cfg.RelayDescription,
 		RelayURL:            fmt.Sprintf("%s%s", s.GetAddr().Host, s.GetAddr().Path),
 		Count:               len(items),
@@ -112,6 +151,10 @@ func (s *Server) handleFrontpage(c *router.Context) {
 		QueryEventsRequests: s.getPrometheusMetric(metrics.QueryEventsRequests.Desc()),
 		NotesBlasted:        s.getPrometheusMetric(metrics.NotesBlasted.Desc()),
 		Version:             config.Version,
+		NoteStyles:          relays.NoteStyles,
+		OutputModes:         models.OutputModes,
+		SeedRelays:          relays.GetSeedRelays(),
+		Viewer:              s.viewerOf(c.Req),
 	}
 
 	if err := tmpl.Execute(c.Out, data); err != nil {
@@ -150,7 +193,7 @@ func (s *Server) handleMetricsDisplay(c *router.Context) {
 		NotesBlasted:        s.getPrometheusMetric(metrics.NotesBlasted.Desc()),
 	}
 
-	tmpl := template.Must(template.ParseFiles(fmt.Sprintf("%s/index.html", s.Cfg.TemplatePath)))
+	tmpl := template.Must(template.New("index.html").Funcs(templateFuncs).ParseFiles(fmt.Sprintf("%s/index.html", s.Cfg.TemplatePath)))
 	if err := tmpl.ExecuteTemplate(c.Out, "metrics-display-fragment", data); err != nil {
 		log.Print("[ERROR] ", err)
 		http.Error(c.Out, err.Error(), http.StatusInternalServerError)
@@ -159,17 +202,18 @@ func (s *Server) handleMetricsDisplay(c *router.Context) {
 
 func (s *Server) handleCreateFeed(c *router.Context, secret *string) {
 	metrics.CreateRequests.Inc()
-	entry := s.createFeed(c.Req, secret)
+	entry := s.createFeed(c.Req.FormValue("url"), c.Req.FormValue("style"), models.OutputMode(c.Req.FormValue("output")), secret)
 
 	followAction := models.FollowManagment{
 		Action: models.Sync,
 	}
-	followManagmentCh <- followAction
+	queueFollowAction(followAction)
 
 	data := struct {
 		RelayName    string
 		PubKey       string
 		NPubKey      string
+		NProfile     string
 		Url          string
 		ImageUrl     string
 		ErrorCode    int
@@ -179,6 +223,7 @@ func (s *Server) handleCreateFeed(c *router.Context, secret *string) {
 		RelayName:    s.Cfg.RelayName,
 		PubKey:       entry.BookmarkEntity.PubKey,
 		NPubKey:      entry.NPubKey,
+		NProfile:     entry.NProfile,
 		Url:          entry.BookmarkEntity.URL,
 		ImageUrl:     entry.BookmarkEntity.ImageURL,
 		ErrorCode:    entry.ErrorCode,
@@ -194,13 +239,27 @@ func (s *Server) handleCreateFeed(c *router.Context, secret *string) {
 	}
 }
 
-func (s *Server) createFeed(r *http.Request, secret *string) *models.GUIEntry {
-	urlParam := r.URL.Query().Get("url")
-
+func (s *Server) createFeed(urlParam, noteTemplate string, outputMode models.OutputMode, secret *string) *models.GUIEntry {
 	guientry := models.GUIEntry{
 		Error: false,
 	}
 
+	if noteTemplate != "" {
+		if _, err := relays.ParseNoteTemplate(noteTemplate); err != nil {
+			guientry.ErrorCode = http.StatusBadRequest
+			guientry.Error = true
+			guientry.ErrorMessage = err.Error()
+			return &guientry
+		}
+	}
+
+	if !slices.Contains(models.OutputModes, outputMode) {
+		guientry.ErrorCode = http.StatusBadRequest
+		guientry.Error = true
+		guientry.ErrorMessage = fmt.Sprintf("Unknown output mode %q", outputMode)
+		return &guientry
+	}
+
 	discFeed, err := yarrworker.DiscoverRssFeed(urlParam)
 	if err != nil || discFeed.FeedLink == "" {
 		guientry.ErrorCode = http.StatusBadRequest
@@ -222,7 +281,7 @@ func (s *Server) createFeed(r *http.Request, secret *string) *models.GUIEntry {
 
 	publicKey = strings.TrimSpace(publicKey)
 
-	if feedExists, err := relays.FeedExists(publicKey, sk, feedUrl); err != nil || feedExists {
+	if feedExists, err := relays.FeedExists(publicKey, feedUrl); err != nil || feedExists {
 		if feedExists {
 			log.Printf("[DEBUG] feedUrl %s with pubkey %s already exists", feedUrl, publicKey)
 			guientry.ErrorMessage = fmt.Sprintf("Feed %s already exists", feedUrl)
@@ -231,6 +290,9 @@ func (s *Server) createFeed(r *http.Request, secret *string) *models.GUIEntry {
 			guientry.ErrorMessage = fmt.Sprintf("Could not determine if feed %s exists", feedUrl)
 		}
 		guientry.ErrorCode = http.StatusInternalServerError
+		if feedExists {
+			guientry.ErrorCode = http.StatusConflict
+		}
 		guientry.Error = true
 		return &guientry
 	}
@@ -247,9 +309,10 @@ func (s *Server) createFeed(r *http.Request, secret *string) *models.GUIEntry {
 	guientry.BookmarkEntity.URL = feedUrl
 	guientry.BookmarkEntity.PubKey = publicKey
 	guientry.NPubKey, _ = nip19.EncodePublicKey(publicKey)
+	guientry.NProfile = relays.NProfile(publicKey)
 	guientry.BookmarkEntity.ImageURL = s.Cfg.DefaultProfilePicUrl
 
-	faviconUrl, err := yarrworker.FindFaviconURL(parsedFeed.Link, feedUrl)
+	faviconUrl, err := yarrworker.FindFaviconURL(parsedFeed.SiteURL, feedUrl)
 	if err != nil {
 		log.Print("[ERROR] FindFavicon", err)
 	} else if faviconUrl != "" {
@@ -260,43 +323,211 @@ func (s *Server) createFeed(r *http.Request, secret *string) *models.GUIEntry {
 		log.Printf("[ERROR] creating metadata note %s", err)
 	}
 
-	// if _, metadataEvent, _ := getLocalMetadataEvent(publicKey); metadataEvent.ID != "" {
-	// 	publishNostrEventCh <- metadataEvent
-	// }
+	entity := models.Entity{
+		PubKey:       publicKey,
+		PrivateKey:   sk,
+		URL:          feedUrl,
+		ImageURL:     guientry.BookmarkEntity.ImageURL,
+		NoteTemplate: noteTemplate,
+		OutputMode:   outputMode,
+	}
 
-	lastPostTime, allPostTimes := relays.InitFeed(publicKey, sk, feedUrl, parsedFeed)
+	lastPostTime, allPostTimes := relays.InitFeed(entity, parsedFeed)
+	entity.LastPostTime = lastPostTime
+	entity.LastCheckedTime = time.Now().Unix()
+	entity.AvgPostTime = relays.CalcAvgPostTime(allPostTimes)
 
-	if err := relays.AddEntityToBookmarkEvent([]models.Entity{
-		{PubKey: publicKey,
-			PrivateKey:      sk,
-			URL:             feedUrl,
-			ImageURL:        guientry.BookmarkEntity.ImageURL,
-			LastPostTime:    lastPostTime,
-			LastCheckedTime: time.Now().Unix(),
-			AvgPostTime:     relays.CalcAvgPostTime(allPostTimes)}}); err != nil {
-		log.Printf("[ERROR] feed entity %s not added to bookmark", feedUrl)
+	if err := relays.AddEntities([]models.Entity{entity}); err != nil {
+		log.Printf("[ERROR] feed entity %s not added to registry", feedUrl)
 	}
 
-	if err := qrcode.WriteFile(fmt.Sprintf("nostr:%s", guientry.NPubKey), qrcode.Low, 128, fmt.Sprintf("%s/%s.png", s.Cfg.QRCodePath, guientry.NPubKey)); err != nil {
+	if err := qrcode.WriteFile(fmt.Sprintf("nostr:%s", guientry.NProfile), qrcode.Low, 128, fmt.Sprintf("%s/%s.png", s.Cfg.QRCodePath, guientry.NPubKey)); err != nil {
 		log.Print("[ERROR]", err)
 	}
 
 	return &guientry
 }
 
+func handleNoteTemplate(c *router.Context) {
+	feedPubkey := c.Req.FormValue("pubkey")
+	noteTemplate := c.Req.FormValue("template")
+
+	if noteTemplate != "" {
+		if _, err := relays.ParseNoteTemplate(noteTemplate); err != nil {
+			http.Error(c.Out, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := relays.UpdateEntity(feedPubkey, func(e *models.Entity) {
+		e.NoteTemplate = noteTemplate
+	})
+	if errors.Is(err, relays.ErrEntityNotFound) {
+		http.Error(c.Out, "feed not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("[ERROR] could not set note template of %s: %s", feedPubkey, err)
+		http.Error(c.Out, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[DEBUG] note template of %s set to %q", feedPubkey, noteTemplate)
+	c.Out.WriteHeader(http.StatusNoContent)
+}
+
+func handleOutputMode(c *router.Context) {
+	feedPubkey := c.Req.FormValue("pubkey")
+	outputMode := models.OutputMode(c.Req.FormValue("output"))
+
+	if !slices.Contains(models.OutputModes, outputMode) {
+		http.Error(c.Out, fmt.Sprintf("unknown output mode %q", outputMode), http.StatusBadRequest)
+		return
+	}
+
+	err := relays.UpdateEntity(feedPubkey, func(e *models.Entity) {
+		e.OutputMode = outputMode
+	})
+	if errors.Is(err, relays.ErrEntityNotFound) {
+		http.Error(c.Out, "feed not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("[ERROR] could not set output mode of %s: %s", feedPubkey, err)
+		http.Error(c.Out, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[DEBUG] output mode of %s set to %q", feedPubkey, outputMode)
+	c.Out.WriteHeader(http.StatusNoContent)
+}
+
+// handleReplication switches a feed between "replicated" and "local".
+func handleReplication(c *router.Context) {
+	feedPubkey := c.Req.FormValue("pubkey")
+	mode := c.Req.FormValue("replication")
+
+	if mode != "replicated" && mode != "local" {
+		http.Error(c.Out, fmt.Sprintf("unknown replication mode %q", mode), http.StatusBadRequest)
+		return
+	}
+
+	err := relays.SetFeedLocalOnly(feedPubkey, mode == "local")
+	if errors.Is(err, relays.ErrEntityNotFound) {
+		http.Error(c.Out, "feed not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("[ERROR] could not set replication of %s: %s", feedPubkey, err)
+		http.Error(c.Out, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[DEBUG] replication of %s set to %q", feedPubkey, mode)
+	c.Out.WriteHeader(http.StatusNoContent)
+}
+
+// handleSaveSeedRelay adds a seed relay or changes its roles, and renders
+// the seed relay table again.
+func (s *Server) handleSaveSeedRelay(c *router.Context) {
+	_, err := relays.SaveSeedRelay(c.Req.FormValue("url"), c.Req.FormValue("read") != "", c.Req.FormValue("write") != "")
+	if errors.Is(err, relays.ErrSeedRelayNoRole) || errors.Is(err, helpers.ErrInvalidRelayURL) {
+		http.Error(c.Out, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("[ERROR] could not save seed relay: %s", err)
+		http.Error(c.Out, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.renderSeedRelays(c)
+}
+
+// handleDeleteSeedRelay removes a seed relay and renders the seed relay
+// table again.
+func (s *Server) handleDeleteSeedRelay(c *router.Context) {
+	err := relays.DeleteSeedRelay(c.Req.FormValue("url"))
+	if errors.Is(err, relays.ErrSeedRelayNotFound) {
+		http.Error(c.Out, err.Error(), http.StatusNotFound)
+		return
+	} else if errors.Is(err, helpers.ErrInvalidRelayURL) {
+		http.Error(c.Out, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("[ERROR] could not delete seed relay: %s", err)
+		http.Error(c.Out, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.renderSeedRelays(c)
+}
+
+func (s *Server) renderSeedRelays(c *router.Context) {
+	data := struct {
+		SeedRelays []models.SeedRelay
+	}{
+		SeedRelays: relays.GetSeedRelays(),
+	}
+
+	tmpl := template.Must(template.New("index.html").Funcs(templateFuncs).ParseFiles(fmt.Sprintf("%s/index.html", s.Cfg.TemplatePath)))
+	if err := tmpl.ExecuteTemplate(c.Out, "seed-relays-fragment", data); err != nil {
+		log.Print("[ERROR] ", err)
+		http.Error(c.Out, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func handleHashtags(c *router.Context) {
+	feedPubkey := c.Req.FormValue("pubkey")
+
+	err := relays.UpdateEntity(feedPubkey, func(e *models.Entity) {
+		e.HashtagAllow = relays.NormalizeHashtagList(c.Req.FormValue("allow"))
+		e.HashtagDeny = relays.NormalizeHashtagList(c.Req.FormValue("deny"))
+		e.AppendHashtags = c.Req.FormValue("append") != ""
+	})
+	if errors.Is(err, relays.ErrEntityNotFound) {
+		http.Error(c.Out, "feed not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("[ERROR] could not set hashtags of %s: %s", feedPubkey, err)
+		http.Error(c.Out, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[DEBUG] hashtag settings of %s updated", feedPubkey)
+	c.Out.WriteHeader(http.StatusNoContent)
+}
+
+// handleCategories replaces the comma separated categories of a feed, and
+// with them its follow sets.
+func handleCategories(c *router.Context) {
+	feedPubkey := c.Req.FormValue("pubkey")
+
+	err := relays.SetFeedCategories(feedPubkey, strings.Split(c.Req.FormValue("categories"), ","))
+	if errors.Is(err, relays.ErrEntityNotFound) {
+		http.Error(c.Out, "feed not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("[ERROR] could not set categories of %s: %s", feedPubkey, err)
+		http.Error(c.Out, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	queueFollowAction(models.FollowManagment{
+		Action: models.Sync,
+	})
+	log.Printf("[DEBUG] categories of %s updated", feedPubkey)
+	c.Out.WriteHeader(http.StatusNoContent)
+}
+
 func handleDeleteFeed(c *router.Context) {
 	metrics.DeleteRequests.Inc()
-	feedPubkey := c.Req.URL.Query().Get("pubkey")
+	feedPubkey := c.Req.FormValue("pubkey")
 
-	followAction := models.FollowManagment{
-		Action:       models.Delete,
-		FollowEntity: models.Entity{PubKey: feedPubkey},
-	}
-	followManagmentCh <- followAction
-	if err := relays.DeleteEntityInBookmarkEvent(feedPubkey); err != nil {
+	if err := relays.DeleteEntity(feedPubkey, c.Req.FormValue("local_only") != ""); err != nil {
 		log.Printf("[ERROR] could not delete feed '%q'...Error: %s ", feedPubkey, err)
 	}
 
+	// the follow list is rebuilt from the remaining feeds
+	followAction := models.FollowManagment{
+		Action: models.Sync,
+	}
+	queueFollowAction(followAction)
+
 	tmpl := template.New("index.html")
 	tmpl.Execute(c.Out, nil)
 }
@@ -333,49 +564,69 @@ func (s *Server) handleImportOpml(c *router.Context) {
 		return
 	}
 
-	doc, err := opml.NewOPML(fileBytes)
+	format, feeds, err := parseImportFile(fileBytes)
 	if err != nil {
-		errMsg := fmt.Sprintf("[ERROR] OPML bad file format %s", err)
+		errMsg := fmt.Sprintf("[ERROR] bad import file format %s", err)
 		log.Print(errMsg)
-		outputFileStatus("[ERROR] OPML bad file format")
+		outputFileStatus("[ERROR] bad import file format")
 		return
 	}
 
+	backgroundJobs.Add(1)
 	go func() {
-		recentImportedEntries = s.importFeeds(doc.Body.Outlines, &s.Cfg.RandomSecret)
+		defer backgroundJobs.Done()
+		setRecentImport(s.importFeeds(feeds, &s.Cfg.RandomSecret, reportImportProgress), format)
 	}()
 
-	log.Print("[DEBUG] opml import started.")
-	outputFileStatus("OPML import starting")
+	log.Printf("[DEBUG] %s import of %d feeds started.", format, len(feeds))
+	outputFileStatus(format + " import starting")
 }
 
-func (s *Server) importFeeds(opmlUrls []opml.Outline, secret *string) []*models.GUIEntry {
+// importFeeds adds the feeds of an import file, calling report after each
+// one. Feeds that already exist get the categories of the file.
+func (s *Server) importFeeds(feeds []importedFeed, secret *string, report func(entryIndex, totalEntries int)) []*models.GUIEntry {
 	importedEntries := make([]*models.GUIEntry, 0)
 	bookmarkEntities := make([]models.Entity, 0)
 
-	for urlIndex, urlParam := range opmlUrls {
-		if !helpers.IsValidHttpUrl(urlParam.XMLURL) {
+	for urlIndex, feed := range feeds {
+		if shuttingDown() {
+			log.Printf("[WARN] import stopped for shutdown after %d of %d feeds", urlIndex, len(feeds))
+			break
+		}
+
+		if feed.Skip != "" {
 			importedEntries = append(importedEntries, &models.GUIEntry{
-				BookmarkEntity: models.Entity{URL: urlParam.XMLURL},
+				BookmarkEntity: models.Entity{URL: feed.URL},
+				ErrorMessage:   feed.Skip,
+				Error:          true,
+				ErrorCode:      http.StatusBadRequest,
+			})
+			report(urlIndex, len(feeds))
+			continue
+		}
+
+		if !helpers.IsValidHttpUrl(feed.URL) {
+			importedEntries = append(importedEntries, &models.GUIEntry{
+				BookmarkEntity: models.Entity{URL: feed.URL},
 				ErrorMessage:   "Invalid URL provided (must be in absolute format and with https or https scheme)...",
 				Error:          true,
 				ErrorCode:      http.StatusBadRequest,
 			})
-			importProgressCh <- models.ImportProgressStruct{EntryIndex: urlIndex, TotalEntries: len(opmlUrls)}
-			log.Printf("[DEBUG] invalid feed url '%q' skipping...", urlParam)
+			report(urlIndex, len(feeds))
+			log.Printf("[DEBUG] invalid feed url '%q' skipping...", feed.URL)
 			continue
 		}
 
-		discFeed, err := yarrworker.DiscoverRssFeed(urlParam.XMLURL)
+		discFeed, err := yarrworker.DiscoverRssFeed(feed.URL)
 		if err != nil || discFeed.FeedLink == "" {
 			importedEntries = append(importedEntries, &models.GUIEntry{
-				BookmarkEntity: models.Entity{URL: urlParam.XMLURL},
+				BookmarkEntity: models.Entity{URL: feed.URL},
 				ErrorMessage:   "Could not find a feed URL in there...",
 				Error:          true,
 				ErrorCode:      http.StatusBadRequest,
 			})
-			importProgressCh <- models.ImportProgressStruct{EntryIndex: urlIndex, TotalEntries: len(opmlUrls)}
-			log.Printf("[DEBUG] Could not find a feed URL in %s", urlParam.XMLURL)
+			report(urlIndex, len(feeds))
+			log.Printf("[DEBUG] Could not find a feed URL in %s", feed.URL)
 			continue
 		}
 		feedUrl := discFeed.FeedLink
@@ -384,37 +635,40 @@ func (s *Server) importFeeds(opmlUrls []opml.Outline, secret *string) []*models.
 		publicKey, err := nostr.GetPublicKey(sk)
 		if err != nil {
 			importedEntries = append(importedEntries, &models.GUIEntry{
-				BookmarkEntity: models.Entity{URL: urlParam.XMLURL},
+				BookmarkEntity: models.Entity{URL: feed.URL},
 				ErrorMessage:   "Bad private key",
 				Error:          true,
 				ErrorCode:      http.StatusBadRequest,
 			})
-			importProgressCh <- models.ImportProgressStruct{EntryIndex: urlIndex, TotalEntries: len(opmlUrls)}
+			report(urlIndex, len(feeds))
 			log.Printf("[ERROR] feed %s bad private key: %s", feedUrl, err)
 			continue
 		}
 
 		publicKey = strings.TrimSpace(publicKey)
 
-		feedExists, err := relays.FeedExists(publicKey, sk, feedUrl)
+		feedExists, err := relays.FeedExists(publicKey, feedUrl)
 		if feedExists {
+			if err := relays.AddFeedCategories(publicKey, feed.Categories); err != nil {
+				log.Printf("[ERROR] adding categories to %s: %s", feedUrl, err)
+			}
 			importedEntries = append(importedEntries, &models.GUIEntry{
-				BookmarkEntity: models.Entity{URL: urlParam.XMLURL},
+				BookmarkEntity: models.Entity{URL: feed.URL},
 				ErrorMessage:   "Feed already exists",
 				Error:          true,
 				ErrorCode:      http.StatusBadRequest,
 			})
-			importProgressCh <- models.ImportProgressStruct{EntryIndex: urlIndex, TotalEntries: len(opmlUrls)}
+			report(urlIndex, len(feeds))
 			log.Printf("[DEBUG] feedUrl %s with pubkey %s already exists", feedUrl, publicKey)
 			continue
 		} else if err != nil {
 			importedEntries = append(importedEntries, &models.GUIEntry{
-				BookmarkEntity: models.Entity{URL: urlParam.XMLURL},
+				BookmarkEntity: models.Entity{URL: feed.URL},
 				ErrorMessage:   "Could not determine if feed exists",
 				Error:          true,
 				ErrorCode:      http.StatusBadRequest,
 			})
-			importProgressCh <- models.ImportProgressStruct{EntryIndex: urlIndex, TotalEntries: len(opmlUrls)}
+			report(urlIndex, len(feeds))
 			log.Printf("[ERROR] could not determine if feedUrl %s with pubkey %s exists", feedUrl, publicKey)
 			continue
 		}
@@ -422,31 +676,32 @@ func (s *Server) importFeeds(opmlUrls []opml.Outline, secret *string) []*models.
 		parsedFeed, err := relays.ParseFeedForUrl(feedUrl)
 		if err != nil {
 			importedEntries = append(importedEntries, &models.GUIEntry{
-				BookmarkEntity: models.Entity{URL: urlParam.XMLURL},
+				BookmarkEntity: models.Entity{URL: feed.URL},
 				ErrorMessage:   "Can not parse feed: " + err.Error(),
 				Error:          true,
 				ErrorCode:      http.StatusBadRequest,
 			})
-			importProgressCh <- models.ImportProgressStruct{EntryIndex: urlIndex, TotalEntries: len(opmlUrls)}
+			report(urlIndex, len(feeds))
 			log.Printf("[ERROR] can not parse feed %s", err)
 			continue
 		}
 
 		npub, _ := nip19.EncodePublicKey(publicKey)
 		guiEntry := models.GUIEntry{
-			BookmarkEntity: models.Entity{URL: urlParam.XMLURL, PubKey: publicKey},
+			BookmarkEntity: models.Entity{URL: feed.URL, PubKey: publicKey},
 			NPubKey:        npub,
+			NProfile:       relays.NProfile(publicKey),
 			ErrorMessage:   "",
 			Error:          false,
 			ErrorCode:      0,
 		}
 
-		if err := qrcode.WriteFile(fmt.Sprintf("nostr:%s", guiEntry.NPubKey), qrcode.Low, 128, fmt.Sprintf("%s/%s.png", s.Cfg.QRCodePath, guiEntry.NPubKey)); err != nil {
+		if err := qrcode.WriteFile(fmt.Sprintf("nostr:%s", guiEntry.NProfile), qrcode.Low, 128, fmt.Sprintf("%s/%s.png", s.Cfg.QRCodePath, guiEntry.NPubKey)); err != nil {
 			log.Print("[ERROR] ", err)
 		}
 
 		localImageURL := s.Cfg.DefaultProfilePicUrl
-		faviconUrl, err := yarrworker.FindFaviconURL(parsedFeed.Link, feedUrl)
+		faviconUrl, err := yarrworker.FindFaviconURL(parsedFeed.SiteURL, feedUrl)
 		if err != nil {
 			log.Print("[ERROR] FindFavicon", err)
 		} else if faviconUrl != "" {
@@ -457,22 +712,30 @@ func (s *Server) importFeeds(opmlUrls []opml.Outline, secret *string) []*models.
 			log.Printf("[ERROR] creating metadata note %s", err)
 		}
 
-		lastPostTime, allPostTimes := relays.InitFeed(publicKey, sk, feedUrl, parsedFeed)
-		bookmarkEntities = append(bookmarkEntities, models.Entity{
-			PubKey:          publicKey,
-			PrivateKey:      sk,
-			URL:             feedUrl,
-			ImageURL:        localImageURL,
-			LastPostTime:    lastPostTime,
-			LastCheckedTime: time.Now().Unix(),
-			AvgPostTime:     relays.CalcAvgPostTime(allPostTimes),
-		})
+		entity := models.Entity{
+			PubKey:     publicKey,
+			PrivateKey: sk,
+			URL:        feedUrl,
+			Title:      cmp.Or(feed.Title, parsedFeed.Title),
+			SiteURL:    cmp.Or(feed.SiteURL, parsedFeed.SiteURL),
+			Categories: feed.Categories,
+			ImageURL:   localImageURL,
+		}
+		// AddEntities keeps the exported name when it is still free
+		if nip05Name, err := relays.NormalizeNIP05Name(feed.NIP05Name); err == nil {
+			entity.NIP05Name = nip05Name
+		}
+		lastPostTime, allPostTimes := relays.InitFeed(entity, parsedFeed)
+		entity.LastPostTime = lastPostTime
+		entity.LastCheckedTime = time.Now().Unix()
+		entity.AvgPostTime = relays.CalcAvgPostTime(allPostTimes)
+		bookmarkEntities = append(bookmarkEntities, entity)
 
 		importedEntries = append(importedEntries, &guiEntry)
-		importProgressCh <- models.ImportProgressStruct{EntryIndex: urlIndex, TotalEntries: len(opmlUrls)}
+		report(urlIndex, len(feeds))
 	}
 
-	if err := relays.AddEntityToBookmarkEvent(bookmarkEntities); err != nil {
+	if err := relays.AddEntities(bookmarkEntities); err != nil {
 		log.Printf("[ERROR] adding feed entities: %s", err)
 	}
 
@@ -480,13 +743,28 @@ func (s *Server) importFeeds(opmlUrls []opml.Outline, secret *string) []*models.
 	followAction := models.FollowManagment{
 		Action: models.Sync,
 	}
-	followManagmentCh <- followAction
+	queueFollowAction(followAction)
 
 	return importedEntries
 }
 
+// reportImportProgress waits for the progress poll, unless the server is
+// shutting down and nobody will ask anymore.
+func reportImportProgress(entryIndex, totalEntries int) {
+	select {
+	case importProgressCh <- models.ImportProgressStruct{EntryIndex: entryIndex, TotalEntries: totalEntries}:
+	case <-quitChannel:
+	}
+}
+
 func (s *Server) handleImportProgress(c *router.Context) {
-	importedURL := <-importProgressCh
+	var importedURL models.ImportProgressStruct
+	select {
+	case importedURL = <-importProgressCh:
+	case <-quitChannel:
+		http.Error(c.Out, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
 	progressPct := ((float32(importedURL.EntryIndex) + 1.0) / float32(importedURL.TotalEntries)) * 100.0
 
 	if importedURL.EntryIndex+1 < importedURL.TotalEntries {
@@ -503,8 +781,9 @@ func (s *Server) handleImportProgress(c *router.Context) {
 func (s *Server) handleImportDetail(c *router.Context) {
 	tmpl := template.Must(template.ParseFiles(fmt.Sprintf("%s/imported.html", s.Cfg.TemplatePath)))
 
+	entries, format := recentImport()
 	numBadFeeds := 0
-	for _, feed := range recentImportedEntries {
+	for _, feed := range entries {
 		if feed.Error {
 			numBadFeeds++
 		}
@@ -520,11 +799,11 @@ func (s *Server) handleImportDetail(c *router.Context) {
 		ErrorCode    int
 	}{
 		RelayName:    s.Cfg.RelayName,
-		Feeds:        recentImportedEntries,
-		GoodFeeds:    len(recentImportedEntries) - numBadFeeds,
+		Feeds:        entries,
+		GoodFeeds:    len(entries) - numBadFeeds,
 		BadFeeds:     numBadFeeds,
 		Error:        false,
-		ErrorMessage: "OPML File Processed",
+		ErrorMessage: format + " File Processed",
 		ErrorCode:    0,
 	}
 
@@ -536,54 +815,21 @@ func (s *Server) handleImportDetail(c *router.Context) {
 }
 
 func (s *Server) handleExportOpml(c *router.Context) {
-	var rssOMPL = &opml.OPML{
-		Version: "1.0",
-		Head: opml.Head{
-			Title:       "rssnotes Feeds",
-			DateCreated: time.Now().Format(time.RFC3339),
-			OwnerName:   "rssnotes",
-		},
-	}
-
-	data, _ := relays.GetSavedEntities()
-
-	for _, feed := range data {
-		rssOMPL.Body.Outlines = append(rssOMPL.Body.Outlines, opml.Outline{
-			Type: "rss",
-			Text: feed.PubKey,
-			//Title:   feed.PrivateKey,
-			XMLURL:  feed.URL,
-			HTMLURL: feed.URL,
-			//Created: strconv.FormatInt(feed.LastUpdate, 10),
-		})
-	}
-
-	c.Out.Header().Add("content-type", "application/opml")
-	c.Out.Header().Add("content-disposition", "attachment; filename="+time.Now().Format(time.DateOnly)+"-rssnotes.opml")
-	outp, err := rssOMPL.XML()
+	outp, err := exportOpml()
 	if err != nil {
 		log.Print("[ERROR] exporting opml file")
 		http.Redirect(c.Out, c.Req, c.Req.Referer(), http.StatusSeeOther)
 		return
 	}
 
+	c.Out.Header().Add("content-type", "application/opml")
+	c.Out.Header().Add("content-disposition", "attachment; filename="+time.Now().Format(time.DateOnly)+"-rssnotes.opml")
 	fmt.Fprintf(c.Out, "%s", outp)
 }
 
 func (s *Server) handleSearch(c *router.Context) {
 
-	funcs := template.FuncMap{
-		"shortURL": func(urlLink string) string {
-			u, err := url.Parse(urlLink)
-			if err != nil {
-				log.Printf("[ERROR] shortURL: %s", err.Error())
-				return urlLink
-			}
-			return strings.TrimPrefix(u.Host, "www.")
-		},
-	}
-
-	tmpl := template.Must(template.New("search.html").Funcs(funcs).ParseFiles(fmt.Sprintf("%s/search.html", s.Cfg.TemplatePath)))
+	tmpl := template.Must(template.New("search.html").Funcs(templateFuncs).ParseFiles(fmt.Sprintf("%s/search.html", s.Cfg.TemplatePath)))
 	//tmpl := template.Must(template.ParseFiles(fmt.Sprintf("%s/search.html", s.Cfg.TemplatePath)))
 	metrics.SearchRequests.Inc()
 	query := c.Req.URL.Query().Get("query")
@@ -596,6 +842,7 @@ func (s *Server) handleSearch(c *router.Context) {
 			Entries       []models.GUIEntry
 			Error         bool
 			ErrorMessage  string
+			Viewer        viewer
 		}{
 			RelayName:     s.Cfg.RelayName,
 			Count:         0,
@@ -603,6 +850,7 @@ func (s *Server) handleSearch(c *router.Context) {
 			Entries:       nil,
 			Error:         true,
 			ErrorMessage:  "Please enter more than 5 characters to search!",
+			Viewer:        s.viewerOf(c.Req),
 		}
 
 		if err := tmpl.Execute(c.Out, errorData); err != nil {
@@ -632,6 +880,7 @@ func (s *Server) handleSearch(c *router.Context) {
 		Entries       []models.GUIEntry
 		Error         bool
 		ErrorMessage  string
+		Viewer        viewer
 	}{
 		RelayName:     s.Cfg.RelayName,
 		Count:         uint64(len(savedEntries)),
@@ -639,6 +888,7 @@ func (s *Server) handleSearch(c *router.Context) {
 		Entries:       items,
 		Error:         false,
 		ErrorMessage:  "",
+		Viewer:        s.viewerOf(c.Req),
 	}
 
 	if err := tmpl.Execute(c.Out, data); err != nil {
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"net/url"
@@ -10,22 +11,27 @@ import (
 	"rssnotes/internal/models"
 	"rssnotes/internal/relays"
 	"strings"
+	"sync"
 
 	"github.com/fiatjaf/khatru"
-	"github.com/nbd-wtf/go-nostr"
 )
 
 var (
 	tickerUpdateFeeds    *time.Ticker
 	tickerDeleteOldNotes *time.Ticker
 	quitChannel          = make(chan struct{})
-	publishNostrEventCh  = make(chan nostr.Event)
-	followManagmentCh    = make(chan models.FollowManagment)
+	followManagmentCh    = make(chan models.FollowManagment, 64)
+	followSyncPending    = make(chan struct{}, 1) // set when followManagmentCh overflowed
+	stateLoopDone        = make(chan struct{})
+	stopOnce             sync.Once
+	backgroundJobs       sync.WaitGroup // imports and direct message commands
 )
 
 type Server struct {
-	Cfg   *config.C
-	relay *khatru.Relay
+	Cfg      *config.C
+	relay    *khatru.Relay
+	managers map[string]bool // hex pubkeys allowed to manage feeds
+	sessions *sessionStore
 }
 
 func NewServer(cfg config.C) *Server {
@@ -38,12 +44,25 @@ func NewServer(cfg config.C) *Server {
 	tickerUpdateFeeds = time.NewTicker(time.Duration(cfg.FeedItemsRefreshMinutes) * time.Minute)
 	tickerDeleteOldNotes = time.NewTicker(time.Duration(24) * time.Hour)
 
+	relays.StartFeedScheduler(cfg.FeedWorkers)
 	go updateRssNotesState()
 
-	return &Server{
-		Cfg:   &cfg,
-		relay: rly,
+	managers := managerPubkeys(cfg.OwnerPubkey, cfg.AdminPubkeys)
+	if len(managers) == 0 {
+		log.Print("[WARN] OWNER_PUBKEY is not set, feed management is disabled")
 	}
+
+	s := &Server{
+		Cfg:      &cfg,
+		relay:    rly,
+		managers: managers,
+		sessions: newSessionStore(),
+	}
+
+	if cfg.DMCommands && len(managers) > 0 {
+		s.startDMCommands()
+	}
+	return s
 }
 
 func (s *Server) Serve() http.Handler {
@@ -65,22 +84,98 @@ func (s *Server) GetAddr() *url.URL {
 }
 
 func updateRssNotesState() {
+	defer close(stateLoopDone)
+
 	for {
 		select {
 		case followAction := <-followManagmentCh:
 			relays.UpdateFollowListEvent(followAction)
-		case nostrEvent := <-publishNostrEventCh:
-			go func() {
-				relays.BlastEvent(&nostrEvent)
-			}()
+		case <-followSyncPending:
+			relays.UpdateFollowListEvent(models.FollowManagment{Action: models.Sync})
 		case <-tickerUpdateFeeds.C:
-			relays.CheckAllFeeds()
+			relays.SyncFeedSchedule()
 		case <-tickerDeleteOldNotes.C:
 			relays.DeleteOldKindTextNoteEvents()
 		case <-quitChannel:
 			tickerUpdateFeeds.Stop()
 			tickerDeleteOldNotes.Stop()
+			relays.StopFeedScheduler()
 			return
 		}
 	}
 }
+
+// flushRssNotesState handles the follow list updates that were queued
+// before shutdown.
+func flushRssNotesState() {
+	for {
+		select {
+		case followAction := <-followManagmentCh:
+			relays.UpdateFollowListEvent(followAction)
+		case <-followSyncPending:
+			relays.UpdateFollowListEvent(models.FollowManagment{Action: models.Sync})
+		default:
+			return
+		}
+	}
+}
+
+// BeginShutdown stops the feed scheduler and tells imports and progress
+// polls to wrap up. It is registered with the http server so that blocked
+// handlers return while requests drain.
+func (s *Server) BeginShutdown() {
+	stopOnce.Do(func() { close(quitChannel) })
+}
+
+// Shutdown waits for running feed checks and imports until ctx expires,
+// flushes queued follow list updates, then stops replication and closes the
+// relay pool and the event store. Events not replicated yet stay in the
+// outbox. When ctx expires first, the store is left open under the jobs
+// still running and the error is returned. The http server must be shut
+// down first.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.BeginShutdown()
+
+	done := make(chan struct{})
+	go func() {
+		<-stateLoopDone
+		backgroundJobs.Wait()
+		flushRssNotesState()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Print("[INFO] background jobs finished")
+	case <-ctx.Done():
+		log.Printf("[WARN] shutdown timed out with jobs still running, leaving the event store open: %s", ctx.Err())
+		return ctx.Err()
+	}
+
+	relays.CloseRelay()
+	return nil
+}
+
+func shuttingDown() bool {
+	select {
+	case <-quitChannel:
+		return true
+	default:
+		return false
+	}
+}
+
+// queueFollowAction hands a follow list update to the control loop without
+// blocking the caller. When the buffer is full, the overflowing updates are
+// coalesced into one sync, which rebuilds the list from the registry.
+func queueFollowAction(followAction models.FollowManagment) {
+	select {
+	case followManagmentCh <- followAction:
+	default:
+		select {
+		case followSyncPending <- struct{}{}:
+			log.Print("[WARN] follow list queue full, syncing the follow list instead")
+		default:
+		}
+	}
+}
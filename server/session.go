@@ -0,0 +1,247 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"rssnotes/server/router"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const sessionCookieName = "rssnotes_session"
+
+type session struct {
+	pubkey    string
+	csrfToken string
+	expires   time.Time
+}
+
+// sessionStore keeps browser sessions and login challenges in memory, so a
+// restart logs everybody out.
+type sessionStore struct {
+	mu         sync.Mutex
+	sessions   map[string]session
+	challenges map[string]time.Time // challenge -> expiry
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{
+		sessions:   make(map[string]session),
+		challenges: make(map[string]time.Time),
+	}
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Panicf("[FATAL] no randomness for tokens: %s", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (st *sessionStore) newChallenge(ttl time.Duration) string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	for challenge, expires := range st.challenges {
+		if now.After(expires) {
+			delete(st.challenges, challenge)
+		}
+	}
+
+	challenge := randomToken()
+	st.challenges[challenge] = now.Add(ttl)
+	return challenge
+}
+
+// useChallenge reports whether the challenge was issued and has not expired.
+// A challenge works only once.
+func (st *sessionStore) useChallenge(challenge string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	expires, ok := st.challenges[challenge]
+	delete(st.challenges, challenge)
+	return ok && time.Now().Before(expires)
+}
+
+func (st *sessionStore) create(pubkey string, ttl time.Duration) (string, session) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	for id, sess := range st.sessions {
+		if now.After(sess.expires) {
+			delete(st.sessions, id)
+		}
+	}
+
+	id := randomToken()
+	sess := session{pubkey: pubkey, csrfToken: randomToken(), expires: now.Add(ttl)}
+	st.sessions[id] = sess
+	return id, sess
+}
+
+func (st *sessionStore) get(id string) (session, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	sess, ok := st.sessions[id]
+	if !ok || time.Now().After(sess.expires) {
+		delete(st.sessions, id)
+		return session{}, false
+	}
+	return sess, true
+}
+
+func (st *sessionStore) delete(id string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.sessions, id)
+}
+
+// sessionOf returns the session of the request cookie, if any.
+func (s *Server) sessionOf(req *http.Request) (string, session, bool) {
+	cookie, err := req.Cookie(sessionCookieName)
+	if err != nil {
+		return "", session{}, false
+	}
+	sess, ok := s.sessions.get(cookie.Value)
+	return cookie.Value, sess, ok
+}
+
+// validCSRF compares the X-CSRF-Token header, or the csrf_token form field,
+// with the token of the session.
+func validCSRF(req *http.Request, sess session) bool {
+	token := req.Header.Get("X-CSRF-Token")
+	if token == "" {
+		token = req.FormValue("csrf_token")
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(sess.csrfToken)) == 1
+}
+
+func (s *Server) sessionCookie(req *http.Request, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    value,
+		Path:     s.Cfg.RelayBasepath + "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   req.TLS != nil || s.GetAddr().Scheme == "https",
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+// viewer is what templates need to know about who is looking.
+type viewer struct {
+	CanManage    bool   // show the controls that change feeds
+	LoggedIn     bool   // has a browser session
+	LoginEnabled bool   // an owner is configured
+	CSRFToken    string // sent back with every change
+}
+
+func (s *Server) viewerOf(req *http.Request) viewer {
+	if len(s.managers) == 0 {
+		return viewer{CanManage: true}
+	}
+
+	v := viewer{LoginEnabled: true}
+	if _, sess, ok := s.sessionOf(req); ok && s.managers[sess.pubkey] {
+		v.CanManage = true
+		v.LoggedIn = true
+		v.CSRFToken = sess.csrfToken
+	}
+	return v
+}
+
+// handleLogin hands out a challenge on GET. On POST it takes a NIP-07
+// signed NIP-98 event for this url carrying the challenge and starts a
+// session for the owner or an admin.
+func (s *Server) handleLogin(c *router.Context) {
+	if len(s.managers) == 0 {
+		http.Error(c.Out, "login is disabled, OWNER_PUBKEY is not set", http.StatusNotFound)
+		return
+	}
+
+	switch c.Req.Method {
+	case http.MethodGet:
+		c.Out.Header().Set("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, map[string]string{
+			"challenge": s.sessions.newChallenge(time.Duration(s.Cfg.AuthMaxAgeSecs) * time.Second),
+		})
+		return
+	case http.MethodPost:
+	default:
+		c.Out.Header().Set("Allow", "GET, POST")
+		http.Error(c.Out, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pubkey, err := s.checkLoginEvent(c.Req)
+	if err != nil {
+		log.Printf("[INFO] login rejected: %s", err)
+		http.Error(c.Out, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !s.managers[pubkey] {
+		log.Printf("[INFO] login rejected for %s", pubkey)
+		http.Error(c.Out, "not allowed to manage this relay", http.StatusForbidden)
+		return
+	}
+
+	ttl := time.Duration(s.Cfg.SessionHours) * time.Hour
+	id, _ := s.sessions.create(pubkey, ttl)
+	http.SetCookie(c.Out, s.sessionCookie(c.Req, id, int(ttl.Seconds())))
+
+	log.Printf("[INFO] %s logged in", pubkey)
+	c.Out.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) checkLoginEvent(req *http.Request) (string, error) {
+	body, err := io.ReadAll(io.LimitReader(req.Body, 64<<10))
+	if err != nil {
+		return "", errors.New("unreadable login event")
+	}
+
+	var evt nostr.Event
+	if err := json.Unmarshal(body, &evt); err != nil {
+		return "", errors.New("invalid login event json")
+	}
+	if err := s.verifyHTTPAuthEvent(evt, req); err != nil {
+		return "", err
+	}
+	if tag := evt.Tags.GetFirst([]string{"challenge", ""}); tag == nil || !s.sessions.useChallenge((*tag)[1]) {
+		return "", errors.New("unknown or expired challenge")
+	}
+	return evt.PubKey, nil
+}
+
+// handleLogout ends the browser session.
+func (s *Server) handleLogout(c *router.Context) {
+	if c.Req.Method != http.MethodPost {
+		c.Out.Header().Set("Allow", "POST")
+		http.Error(c.Out, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if id, sess, ok := s.sessionOf(c.Req); ok {
+		if !validCSRF(c.Req, sess) {
+			http.Error(c.Out, "invalid csrf token", http.StatusForbidden)
+			return
+		}
+		s.sessions.delete(id)
+	}
+
+	http.SetCookie(c.Out, s.sessionCookie(c.Req, "", -1))
+	c.Out.Header().Set("HX-Refresh", "true")
+	c.Out.WriteHeader(http.StatusNoContent)
+}
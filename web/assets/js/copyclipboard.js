@@ -9,7 +9,7 @@ gallery.addEventListener('click', async (e) => {
         const card = e.target.closest('.card');
         const message = document.createElement('div');
         message.className = 'message';
-        message.textContent = 'npub copied!';
+        message.textContent = 'nprofile copied!';
         //message.textContent = `Copied!: ${textToCopy}`;
         message.style.backgroundColor = '#4CAF50';
         message.style.borderRadius='8px'
@@ -0,0 +1,42 @@
+const loginButton = document.getElementById('login-button');
+
+// Sign the server challenge with a NIP-07 extension, as a NIP-98 event for
+// the login url, and trade it for a session cookie.
+loginButton.addEventListener('click', async (e) => {
+    e.preventDefault();
+
+    if (!window.nostr) {
+        alert('Login needs a Nostr browser extension (NIP-07), like nos2x or Alby.');
+        return;
+    }
+
+    const loginUrl = new URL('./login', document.baseURI).href;
+
+    try {
+        const res = await fetch(loginUrl, { cache: 'no-store' });
+        if (!res.ok) {
+            throw new Error(await res.text());
+        }
+        const { challenge } = await res.json();
+
+        const event = await window.nostr.signEvent({
+            kind: 27235,
+            created_at: Math.floor(Date.now() / 1000),
+            tags: [['u', loginUrl], ['method', 'POST'], ['challenge', challenge]],
+            content: '',
+        });
+
+        const login = await fetch(loginUrl, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(event),
+        });
+        if (!login.ok) {
+            throw new Error(await login.text());
+        }
+        window.location.reload();
+    } catch (err) {
+        console.error('Login failed:', err);
+        alert('Login failed: ' + err.message);
+    }
+});